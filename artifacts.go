@@ -0,0 +1,72 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// ciArtifact is a file a CI build saved
+type ciArtifact struct {
+	Path string `json:"path"`
+	URL  string `json:"url"`
+}
+
+// globMatch is path.Match, plus "**" matching any number of directories
+func globMatch(pattern string, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(strings.TrimPrefix(name, "/"), "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchingArtifacts returns the artifacts whose path matches any of globs
+func matchingArtifacts(artifacts []ciArtifact, globs []string) []ciArtifact {
+	var ret []ciArtifact
+	for _, a := range artifacts {
+		for _, g := range globs {
+			if globMatch(g, a.Path) {
+				ret = append(ret, a)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// fetchMatchingArtifacts downloads every one of a build's artifacts that matches globs and hands
+// each to fn.  A single artifact that cannot be downloaded is logged and skipped.
+func fetchMatchingArtifacts(ctx context.Context, ci ciProvider, artifacts []ciArtifact, globs []string, fn func(a ciArtifact, body []byte) error) error {
+	l := getLog(ctx)
+	for _, a := range matchingArtifacts(artifacts, globs) {
+		body, err := ci.fetchArtifact(ctx, a)
+		if err != nil {
+			logIfErr(l, err, "cannot download artifact %s", a.Path)
+			continue
+		}
+		if err := fn(a, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
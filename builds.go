@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// trackedBuild is a CI build the bridge scheduled for a Harbormaster build target
+type trackedBuild struct {
+	TargetPHID string `json:"target_phid"`
+	Diff       int    `json:"diff"`
+	Revision   int    `json:"revision"`
+	Callsign   string `json:"callsign"`
+	Username   string `json:"username"`
+	Project    string `json:"project"`
+	BuildNum   int    `json:"build_num"`
+	BuildURL   string `json:"build_url"`
+	StagingRef string `json:"staging_ref"`
+	StagingURI string `json:"staging_uri"`
+	// Queued is set until the build is seen running, for targets marked working only then
+	Queued bool `json:"queued,omitempty"`
+}
+
+// buildRecord is the history of one build, as kept by buildTracker
+type buildRecord struct {
+	trackedBuild
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Outcome    string     `json:"outcome,omitempty"`
+	Superseded bool       `json:"superseded,omitempty"`
+}
+
+func (r *buildRecord) running() bool {
+	return r.Finished == nil && !r.Superseded
+}
+
+// buildRetention is how long finished builds are kept
+const buildRetention = time.Hour * 24 * 30
+
+// buildTracker records every build the bridge schedules.  With a file name, the records are
+// saved to that file after every change and survive restarts.  A nil buildTracker tracks nothing.
+type buildTracker struct {
+	mu       sync.Mutex
+	filename string
+	builds   map[string]*buildRecord
+	now      func() time.Time
+}
+
+func newBuildTracker() *buildTracker {
+	return &buildTracker{
+		builds: make(map[string]*buildRecord),
+		now:    time.Now,
+	}
+}
+
+// loadBuildTracker reads the builds saved in filename, which need not exist yet.  A file that
+// cannot be decoded is moved aside, so a damaged store does not keep the bridge from starting.
+func loadBuildTracker(l logger, filename string) (*buildTracker, error) {
+	ret := newBuildTracker()
+	if filename == "" {
+		return ret, nil
+	}
+	ret.filename = filename
+	contents, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, wraperr(err, "cannot read build store %s", filename)
+	}
+	var records []*buildRecord
+	if err := json.Unmarshal(contents, &records); err != nil {
+		aside := filename + ".corrupt"
+		if renameErr := os.Rename(filename, aside); renameErr != nil {
+			return nil, wraperr(renameErr, "cannot move undecodable build store %s aside", filename)
+		}
+		warnf(l, "Cannot decode build store %s.  Moved it to %s and starting without records: %s", filename, aside, err.Error())
+		return ret, nil
+	}
+	for _, r := range records {
+		ret.builds[r.TargetPHID] = r
+	}
+	return ret, nil
+}
+
+// prune drops finished builds older than buildRetention.  It is called with mu held.
+func (b *buildTracker) prune() {
+	for phid, r := range b.builds {
+		if r.Finished != nil && b.now().Sub(*r.Finished) > buildRetention {
+			delete(b.builds, phid)
+		}
+	}
+}
+
+// save writes every record to the store file, replacing it atomically.  It is called with mu held.
+func (b *buildTracker) save(ctx context.Context) {
+	if b.filename == "" {
+		return
+	}
+	records := make([]*buildRecord, 0, len(b.builds))
+	for _, r := range b.builds {
+		records = append(records, r)
+	}
+	sort.Sort(byStarted(records))
+	contents, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		logIfErr(getLog(ctx), err, "cannot encode build store")
+		return
+	}
+	tmp := b.filename + ".tmp"
+	if err := writeSynced(tmp, contents); err != nil {
+		logIfErr(getLog(ctx), err, "cannot write build store %s", tmp)
+		return
+	}
+	logIfErr(getLog(ctx), os.Rename(tmp, b.filename), "cannot replace build store %s", b.filename)
+}
+
+// writeSynced writes contents to filename and flushes it to disk, so a rename over the old store
+// never leaves an empty or partial file after a crash
+func writeSynced(filename string, contents []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type byStarted []*buildRecord
+
+func (s byStarted) Len() int           { return len(s) }
+func (s byStarted) Less(i, j int) bool { return s[i].Started.Before(s[j].Started) }
+func (s byStarted) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// start records a newly scheduled build.  If the revision has a running build for another diff,
+// the build of the older diff is marked superseded and returned, along with the newer diff.  A
+// target that is already recorded, such as from a redelivered message, keeps its record.
+func (b *buildTracker) start(ctx context.Context, build trackedBuild) (*trackedBuild, int) {
+	if b == nil {
+		return nil, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, exists := b.builds[build.TargetPHID]; exists {
+		return nil, 0
+	}
+	b.prune()
+	defer b.save(ctx)
+	record := &buildRecord{
+		trackedBuild: build,
+		Started:      b.now(),
+	}
+	b.builds[build.TargetPHID] = record
+	if build.Revision == 0 {
+		return nil, 0
+	}
+	for _, old := range b.builds {
+		if old == record || old.Revision != build.Revision || !old.running() {
+			continue
+		}
+		if old.Diff > build.Diff {
+			// A late message for an older diff: its build is the one to stop
+			record.Superseded = true
+			return &record.trackedBuild, old.Diff
+		}
+		old.Superseded = true
+		return &old.trackedBuild, build.Diff
+	}
+	return nil, 0
+}
+
+// published returns whether a target's build was superseded, and whether its outcome was already
+// recorded.  It changes nothing, so a publish that fails can be retried.
+func (b *buildTracker) published(phid string) (bool, bool) {
+	if b == nil {
+		return false, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, exists := b.builds[phid]
+	if !exists {
+		return false, false
+	}
+	return r.Superseded, r.Finished != nil
+}
+
+// markFinished records the outcome of a target's build.  Call it only once Harbormaster has the
+// result, or once there is no result to send.
+func (b *buildTracker) markFinished(ctx context.Context, phid string, outcome string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, exists := b.builds[phid]
+	if !exists || r.Finished != nil {
+		return
+	}
+	defer b.save(ctx)
+	now := b.now()
+	r.Finished = &now
+	r.Outcome = outcome
+	b.prune()
+}
+
+// diffRunning is whether a build of diff other than the target's is still running.  Such a build
+// needs the diff's staging branch and tag.
+func (b *buildTracker) diffRunning(phid string, diff int) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.builds {
+		if r.TargetPHID != phid && r.Diff == diff && r.running() {
+			return true
+		}
+	}
+	return false
+}
+
+// queued returns the builds with no outcome yet that have not been seen running
+func (b *buildTracker) queued() []buildRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ret []buildRecord
+	for _, r := range b.builds {
+		if r.Queued && r.running() {
+			ret = append(ret, *r)
+		}
+	}
+	return ret
+}
+
+// markRunning records that a queued build was seen running
+func (b *buildTracker) markRunning(ctx context.Context, phid string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, exists := b.builds[phid]
+	if !exists || !r.Queued {
+		return
+	}
+	defer b.save(ctx)
+	r.Queued = false
+}
+
+// overdue returns the builds started more than timeout ago that have no outcome yet
+func (b *buildTracker) overdue(timeout time.Duration) []buildRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ret []buildRecord
+	for _, r := range b.builds {
+		if r.Finished == nil && b.now().Sub(r.Started) > timeout {
+			ret = append(ret, *r)
+		}
+	}
+	return ret
+}
+
+// inFlight counts the builds still waiting on a result
+func (b *buildTracker) inFlight() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ret := 0
+	for _, r := range b.builds {
+		if r.running() {
+			ret++
+		}
+	}
+	return ret
+}
+
+// age is how long ago the build started
+func (b *buildTracker) age(r buildRecord) time.Duration {
+	return b.now().Sub(r.Started)
+}
+
+// get returns the record of a target's build
+func (b *buildTracker) get(phid string) (buildRecord, bool) {
+	if b == nil {
+		return buildRecord{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, exists := b.builds[phid]
+	if !exists {
+		return buildRecord{}, false
+	}
+	return *r, true
+}
+
+// cancelSuperseded stops the build of a diff that a newer diff replaced, on the provider the old
+// build ran on, and fails its build target with a note saying why
+func cancelSuperseded(ctx context.Context, ci *ciRegistry, phab *phabricatorConduit, old *trackedBuild, diff int) {
+	l := getLog(ctx)
+	l.Printf("Diff %d replaces diff %d.  Canceling build %s", diff, old.Diff, old.BuildURL)
+	if provider, err := ci.forCallsign(old.Callsign); err != nil {
+		logIfErr(l, err, "cannot cancel superseded build %d", old.BuildNum)
+	} else {
+		logIfErr(l, provider.cancelBuild(ctx, old.Username, old.Project, old.BuildNum), "cannot cancel superseded build %d", old.BuildNum)
+	}
+	details := fmt.Sprintf("Canceled because Diff %d replaced Diff %d", diff, old.Diff)
+	if diff == old.Diff {
+		details = fmt.Sprintf("Canceled because a newer build of Diff %d started", diff)
+	}
+	units := []harbormasterUnitResult{
+		{
+			Name:    "Superseded",
+			Result:  unitSkip,
+			Details: details,
+		},
+	}
+	logIfErr(l, phab.updateHarbormaster(ctx, old.TargetPHID, harbormasterFail, units, nil), "cannot fail superseded target %s", old.TargetPHID)
+}
+
+// splitProject splits a "username/project" CircleCI project
+func splitProject(project string) (string, string) {
+	parts := strings.SplitN(project, "/", 2)
+	if len(parts) != 2 {
+		return "", project
+	}
+	return parts[0], parts[1]
+}
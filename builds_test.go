@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestBuildTrackerSupersedes(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	b := newBuildTracker()
+	old, _ := b.start(ctx, trackedBuild{TargetPHID: "PHID-1", Diff: 10, Revision: 5, BuildNum: 1})
+	assert.Nil(t, old)
+
+	old, newer := b.start(ctx, trackedBuild{TargetPHID: "PHID-2", Diff: 11, Revision: 5, BuildNum: 2})
+	assert.Equal(t, "PHID-1", old.TargetPHID)
+	assert.Equal(t, 11, newer)
+
+	// A late message for the older diff loses to the running build
+	old, newer = b.start(ctx, trackedBuild{TargetPHID: "PHID-0", Diff: 9, Revision: 5, BuildNum: 3})
+	assert.Equal(t, "PHID-0", old.TargetPHID)
+	assert.Equal(t, 11, newer)
+
+	// Other revisions are independent, and builds without a revision supersede nothing
+	old, _ = b.start(ctx, trackedBuild{TargetPHID: "PHID-3", Diff: 12, Revision: 6})
+	assert.Nil(t, old)
+	old, _ = b.start(ctx, trackedBuild{TargetPHID: "PHID-4", Diff: 13})
+	assert.Nil(t, old)
+
+	superseded, finishedBefore := b.published("PHID-1")
+	assert.True(t, superseded)
+	assert.False(t, finishedBefore)
+	superseded, _ = b.published("PHID-0")
+	assert.True(t, superseded)
+	superseded, finishedBefore = b.published("PHID-2")
+	assert.False(t, superseded || finishedBefore)
+	// Checking records nothing, so a failed publish is tried again
+	_, finishedBefore = b.published("PHID-2")
+	assert.False(t, finishedBefore)
+	b.markFinished(ctx, "PHID-2", "success")
+	b.markFinished(ctx, "PHID-2", "failed")
+	_, finishedBefore = b.published("PHID-2")
+	assert.True(t, finishedBefore)
+	superseded, finishedBefore = b.published("PHID-unknown")
+	assert.False(t, superseded || finishedBefore)
+	r, exists := b.get("PHID-2")
+	assert.True(t, exists)
+	assert.Equal(t, "success", r.Outcome)
+	assert.NotNil(t, r.Finished)
+
+	var nilTracker *buildTracker
+	old, _ = nilTracker.start(ctx, trackedBuild{TargetPHID: "PHID-1", Revision: 5})
+	assert.Nil(t, old)
+	nilTracker.markFinished(ctx, "PHID-1", "success")
+	superseded, finishedBefore = nilTracker.published("PHID-1")
+	assert.False(t, superseded || finishedBefore)
+}
+
+func TestBuildTrackerKeepsRecords(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	b := newBuildTracker()
+	b.start(ctx, trackedBuild{TargetPHID: "PHID-1", Diff: 10, Revision: 5, BuildNum: 1})
+	b.markFinished(ctx, "PHID-1", "success")
+
+	// A redelivered message for the same target does not wipe its outcome
+	old, _ := b.start(ctx, trackedBuild{TargetPHID: "PHID-1", Diff: 10, Revision: 5, BuildNum: 2})
+	assert.Nil(t, old)
+	r, _ := b.get("PHID-1")
+	assert.Equal(t, 1, r.BuildNum)
+	assert.Equal(t, "success", r.Outcome)
+
+	// Old finished builds are dropped without a store file too
+	b.now = func() time.Time { return time.Now().Add(buildRetention * 2) }
+	b.start(ctx, trackedBuild{TargetPHID: "PHID-2", Diff: 11, Revision: 6})
+	_, exists := b.get("PHID-1")
+	assert.False(t, exists)
+	_, exists = b.get("PHID-2")
+	assert.True(t, exists)
+}
+
+func TestBuildTrackerPersists(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	dir, err := ioutil.TempDir("", "buildstore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "builds.json")
+
+	b, err := loadBuildTracker(getLog(ctx), filename)
+	assert.Nil(t, err)
+	b.start(ctx, trackedBuild{TargetPHID: "PHID-1", Diff: 10, Revision: 5, BuildNum: 1})
+	b.start(ctx, trackedBuild{TargetPHID: "PHID-old", Diff: 2, Revision: 1})
+	b.markFinished(ctx, "PHID-old", "success")
+
+	reloaded, err := loadBuildTracker(getLog(ctx), filename)
+	assert.Nil(t, err)
+	r, exists := reloaded.get("PHID-1")
+	assert.True(t, exists)
+	assert.Equal(t, 1, r.BuildNum)
+	assert.Nil(t, r.Finished)
+
+	// The running build is still superseded after a restart
+	old, _ := reloaded.start(ctx, trackedBuild{TargetPHID: "PHID-2", Diff: 11, Revision: 5})
+	assert.Equal(t, "PHID-1", old.TargetPHID)
+
+	// Old finished builds are dropped
+	reloaded.now = func() time.Time { return time.Now().Add(buildRetention * 2) }
+	reloaded.markFinished(ctx, "PHID-2", "success")
+	reloaded, err = loadBuildTracker(getLog(ctx), filename)
+	assert.Nil(t, err)
+	_, exists = reloaded.get("PHID-old")
+	assert.False(t, exists)
+	_, exists = reloaded.get("PHID-2")
+	assert.True(t, exists)
+
+	// An undecodable store is moved aside instead of stopping the bridge
+	assert.Nil(t, ioutil.WriteFile(filename, []byte("not json"), 0600))
+	reloaded, err = loadBuildTracker(getLog(ctx), filename)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, reloaded.inFlight())
+	aside, err := ioutil.ReadFile(filename + ".corrupt")
+	assert.Nil(t, err)
+	assert.Equal(t, "not json", string(aside))
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCancelSuperseded(t *testing.T) {
+	p, server, calls := newTestConduit(t, `{"result": {}, "error_code": null, "error_info": null}`)
+	defer server.Close()
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	ci := &fakeCI{}
+	v2 := &fakeCI{}
+	reg := &ciRegistry{
+		configs: &repoConfigs{
+			Repositories: map[string]repoConfig{"ABC": {CI: circleV2Provider}},
+		},
+		providers: map[string]ciProvider{defaultCIProvider: ci, circleV2Provider: v2},
+	}
+
+	// The old build is canceled where it ran, whatever provider the new build uses
+	cancelSuperseded(ctx, reg, p, &trackedBuild{TargetPHID: "PHID-0", Diff: 10, Callsign: "ABC", Username: "signalfx", Project: "arepo", BuildNum: 3}, 11)
+	assert.Equal(t, []int{3}, v2.canceled)
+	assert.Empty(t, ci.canceled)
+	cancelSuperseded(ctx, reg, p, &trackedBuild{TargetPHID: "PHID-1", Diff: 10, Callsign: "XYZ", Username: "signalfx", Project: "arepo", BuildNum: 7}, 11)
+	assert.Equal(t, []int{7}, ci.canceled)
+	form := calls["/api/harbormaster.sendmessage"]
+	assert.Equal(t, "PHID-1", form.Get("buildTargetPHID"))
+	assert.Equal(t, string(harbormasterFail), form.Get("type"))
+	var units []harbormasterUnitResult
+	assert.Nil(t, json.Unmarshal([]byte(form.Get("unit")), &units))
+	assert.Equal(t, "Canceled because Diff 11 replaced Diff 10", units[0].Details)
+}
+
+func TestSplitProject(t *testing.T) {
+	u, p := splitProject("signalfx/arepo")
+	assert.Equal(t, "signalfx", u)
+	assert.Equal(t, "arepo", p)
+}
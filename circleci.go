@@ -5,7 +5,6 @@ import (
 
 	"bytes"
 	"fmt"
-	"github.com/aws/aws-sdk-go/service/sqs"
 	"golang.org/x/net/context"
 	"strconv"
 	"strings"
@@ -17,8 +16,11 @@ type circleCiMsg struct {
 	AllParams  map[string]map[string]string `json:"allParamsJson"`
 	FormParams circleMsg                    `json:"formparams"`
 
-	originalMsg *sqs.Message
+	originalMsg *message
 	parent      *circleManager
+	// provider is the CI the build ran on, when the message itself says.  Otherwise it is the one
+	// configured for the repository.
+	provider ciProvider
 }
 
 type circleMsg struct {
@@ -26,9 +28,11 @@ type circleMsg struct {
 }
 
 type circleManager struct {
-	git  *githubPusher
-	phab *phabricatorConduit
-	ci   *circleClient
+	git     *githubPusher
+	phab    *phabricatorConduit
+	ci      *ciRegistry
+	configs *repoConfigs
+	builds  *buildTracker
 }
 
 type circleCiPayload struct {
@@ -43,12 +47,12 @@ type circleCiPayload struct {
 	BuildParameters map[string]string `json:"build_parameters"`
 }
 
-func (c *circleManager) parseCircleCImsg(msg *sqs.Message) (parsedMessage, error) {
+func (c *circleManager) parseCircleCImsg(msg *message) (parsedMessage, error) {
 	g := circleCiMsg{
 		originalMsg: msg,
 		parent:      c,
 	}
-	err := json.Unmarshal([]byte(*msg.Body), &g)
+	err := json.Unmarshal([]byte(msg.Body), &g)
 	if err != nil {
 		return nil, err
 	}
@@ -58,10 +62,62 @@ func (c *circleManager) parseCircleCImsg(msg *sqs.Message) (parsedMessage, error
 	return nil, errNotValidMessageType
 }
 
-func (g *circleCiMsg) OriginalMsg() *sqs.Message {
+func (g *circleCiMsg) OriginalMsg() *message {
 	return g.originalMsg
 }
 
+func (g *circleCiMsg) logFields() map[string]interface{} {
+	diff, revision := g.diffIds()
+	return map[string]interface{}{
+		"diff":       int(diff),
+		"revision":   int(revision),
+		"phid":       g.FormParams.Payload.BuildParameters["phid"],
+		"repository": g.callsign(),
+		"build_num":  g.FormParams.Payload.BuildNum,
+	}
+}
+
+// SerializationKey is empty so build results publish concurrently.  The git cleanup they do is
+// guarded by githubPusher.
+func (g *circleCiMsg) SerializationKey() string {
+	return ""
+}
+
+// callsign is the repository the build is for.  CircleCI v2 pipelines are not passed the
+// callsign, since every pipeline parameter must be declared, so it comes from the build record.
+func (g *circleCiMsg) callsign() string {
+	if callsign := g.FormParams.Payload.BuildParameters["callsign"]; callsign != "" {
+		return callsign
+	}
+	if g.parent == nil {
+		return ""
+	}
+	r, _ := g.parent.builds.get(g.FormParams.Payload.BuildParameters["phid"])
+	return r.Callsign
+}
+
+// ci is the provider to read the build's results from
+func (g *circleCiMsg) ci() (ciProvider, error) {
+	if g.provider != nil {
+		return g.provider, nil
+	}
+	return g.parent.ci.forCallsign(g.callsign())
+}
+
+func (g *circleCiMsg) repoConfig() repoConfig {
+	if g.parent.configs == nil {
+		return (&repoConfigs{}).forCallsign("")
+	}
+	return g.parent.configs.forCallsign(g.callsign())
+}
+
+func (g *circleCiMsg) commentTemplate() *template.Template {
+	if g.parent.configs == nil {
+		return diffResultTemplate
+	}
+	return g.parent.configs.commentTemplate(g.callsign())
+}
+
 func (g *circleCiMsg) diffIds() (int64, int64) {
 	if g.FormParams.Payload.BuildParameters == nil {
 		return 0, 0
@@ -107,48 +163,68 @@ var diffResultTemplate = template.Must(template.New("").Parse(
 type diffResultStruct struct {
 	BuildResult  string
 	BuildTime    time.Duration
+	BuildURL     string
 	TestCount    int
 	FailingTests int
 	PassingTests int
 	SkippedTests int
 	BuildNumber  int
-	Tests        []diffResultTestStruct
+	// Tests are the first few failures, with their output trimmed
+	Tests []diffResultTestStruct
+	// AllTests are every test of the build, with their full output
+	AllTests  []diffResultTestStruct
+	Artifacts []ciArtifact
 }
 
 type diffResultTestStruct struct {
 	Classname string
 	TestName  string
+	Result    string
 	Duration  time.Duration
 	Message   string
 }
 
-func testResultMsg(cr circleTestResult) diffResultTestStruct {
+func testResultMsg(cr circleTestResult, limit int) diffResultTestStruct {
 	msg := ""
 	if cr.Message != nil {
 		msg = *cr.Message
 	}
-	if len(msg) > 300 {
-		msg = msg[:299] + "... (trimmed output)"
-	}
 	return diffResultTestStruct{
 		Classname: cr.Classname,
 		TestName:  cr.Name,
+		Result:    cr.Result,
 		Duration:  time.Duration(int64(cr.RunTime * float64(time.Second.Nanoseconds()))),
-		Message:   msg,
+		Message:   trimOutput(msg, limit),
+	}
+}
+
+// trimOutput cuts msg down to about limit bytes.  A limit of zero or less means no limit.
+func trimOutput(msg string, limit int) string {
+	if limit <= 0 || len(msg) <= limit {
+		return msg
 	}
+	return msg[:limit-1] + "... (trimmed output)"
 }
 
-func (g *circleCiMsg) populateTestResults(ctx context.Context) (diffResultStruct, []harbormasterUnitResult, error) {
-	ciTestResults, err := g.parent.ci.testResults(ctx, g.FormParams.Payload.Username, g.FormParams.Payload.Reponame, g.FormParams.Payload.BuildNum)
+func (g *circleCiMsg) populateTestResults(ctx context.Context, ci ciProvider, artifacts []ciArtifact) (diffResultStruct, []harbormasterUnitResult, error) {
+	ciTestResults, err := ci.testResults(ctx, g.FormParams.Payload.Username, g.FormParams.Payload.Reponame, g.FormParams.Payload.BuildNum)
 	if err != nil {
 		return diffResultStruct{}, nil, wraperr(err, "cannot get build results for %d", g.FormParams.Payload.BuildNum)
 	}
+	if len(ciTestResults) == 0 {
+		ciTestResults, err = g.junitTestResults(ctx, ci, artifacts)
+		if err != nil {
+			return diffResultStruct{}, nil, wraperr(err, "cannot get JUnit results for %d", g.FormParams.Payload.BuildNum)
+		}
+	}
 
 	var unitTestResults []harbormasterUnitResult
+	detailsLimit := g.repoConfig().UnitDetailsLimit
 
 	s := diffResultStruct{
 		BuildResult: g.FormParams.Payload.Outcome,
 		BuildTime:   time.Duration(int64(g.FormParams.Payload.BuildTimeMS) * time.Millisecond.Nanoseconds()),
+		BuildURL:    g.FormParams.Payload.BuildURL,
 		BuildNumber: g.FormParams.Payload.BuildNum,
 		TestCount:   len(ciTestResults),
 	}
@@ -174,13 +250,17 @@ func (g *circleCiMsg) populateTestResults(ctx context.Context) (diffResultStruct
 				tr.Result = unitFail
 				s.FailingTests++
 				if len(s.Tests) < 3 {
-					s.Tests = append(s.Tests, testResultMsg(circleTestResult))
+					s.Tests = append(s.Tests, testResultMsg(circleTestResult, 300))
 				}
 			}
 			if circleTestResult.File != nil {
 				tr.Path = *circleTestResult.File
 			}
+			if circleTestResult.Message != nil {
+				tr.Details = trimOutput(*circleTestResult.Message, detailsLimit)
+			}
 			unitTestResults = append(unitTestResults, tr)
+			s.AllTests = append(s.AllTests, testResultMsg(circleTestResult, 0))
 		}
 	}
 	return s, unitTestResults, nil
@@ -205,6 +285,13 @@ func (g *circleCiMsg) Execute(ctx context.Context) error {
 		return nil
 	}
 
+	return g.publishResults(ctx)
+}
+
+// publishResults reports a finished phabricator build back to Harbormaster and the diff, then
+// cleans up the staging branch and tag
+func (g *circleCiMsg) publishResults(ctx context.Context) error {
+	l := getLog(ctx)
 	diff, revision := g.diffIds()
 	if diff == 0 || revision == 0 {
 		l.Printf("Cannot parse diff/reivision out of %v", g.FormParams.Payload.BuildParameters)
@@ -217,34 +304,78 @@ func (g *circleCiMsg) Execute(ctx context.Context) error {
 		return wraperr(err, "cannot get clone directory")
 	}
 
-	msgStruct, unitTestResults, err := g.populateTestResults(ctx)
+	phid := g.FormParams.Payload.BuildParameters["phid"]
+	superseded, finishedBefore := g.parent.builds.published(phid)
+	if finishedBefore {
+		l.Printf("Results of build %d were already published", g.FormParams.Payload.BuildNum)
+		return nil
+	}
+	if superseded {
+		l.Printf("Build %d was superseded by a newer diff.  Only cleaning up", g.FormParams.Payload.BuildNum)
+		g.parent.builds.markFinished(ctx, phid, g.FormParams.Payload.Outcome)
+		g.cleanup(ctx, repoURI, repoDir, diff)
+		return nil
+	}
+
+	ci, err := g.ci()
+	if err != nil {
+		return wraperr(err, "cannot find CI provider of build %d", g.FormParams.Payload.BuildNum)
+	}
+
+	// Listing artifacts can take a call per job, so it is done once for every reader
+	p := g.FormParams.Payload
+	artifacts, err := ci.artifacts(ctx, p.Username, p.Reponame, p.BuildNum)
+	logIfErr(l, err, "cannot list artifacts of build %d", p.BuildNum)
+
+	msgStruct, unitTestResults, err := g.populateTestResults(ctx, ci, artifacts)
 	if err != nil {
 		return wraperr(err, "cannot create test results struct")
 	}
+	msgStruct.Artifacts = artifacts
+
+	lints, err := g.lintResults(ctx, ci, artifacts)
+	logIfErr(l, err, "cannot read lint results of build %d", p.BuildNum)
+
+	coverage, err := g.coverage(ctx, ci, artifacts)
+	logIfErr(l, err, "cannot read coverage of build %d", p.BuildNum)
+	unitTestResults = attachCoverage(unitTestResults, coverage)
 
 	pt := g.harbormasterResult()
 
 	buf := &bytes.Buffer{}
-	if err := diffResultTemplate.Execute(buf, msgStruct); err != nil {
+	if err := g.commentTemplate().Execute(buf, msgStruct); err != nil {
 		return wraperr(err, "cannot build template for phab message")
 	}
 
-	if err := g.parent.phab.updateHarbormaster(ctx, g.FormParams.Payload.BuildParameters["phid"], pt, unitTestResults, nil); err != nil {
+	if err := g.parent.phab.updateHarbormaster(ctx, phid, pt, unitTestResults, lints); err != nil {
 		return wraperr(err, "cannot post phab comment to %d", revision)
 	}
+	// Harbormaster has the result, so a retry would find nothing left to publish.  Anything that
+	// fails from here on is logged rather than retried.
+	g.parent.builds.markFinished(ctx, phid, g.FormParams.Payload.Outcome)
 
-	if err := g.parent.phab.createComment(ctx, int(revision), buf.String()); err != nil {
-		return wraperr(err, "cannot post phab comment to %d", revision)
+	if g.repoConfig().commentOnResult() {
+		logIfErr(l, g.parent.phab.createComment(ctx, int(revision), buf.String()), "cannot post result comment to %d", revision)
 	}
 
+	g.cleanup(ctx, repoURI, repoDir, diff)
+	return nil
+}
+
+// cleanup removes the staging branch and tag of a finished build, unless a newer build of the same
+// diff still needs them
+func (g *circleCiMsg) cleanup(ctx context.Context, repoURI string, repoDir string, diff int64) {
+	l := getLog(ctx)
+	if g.parent.builds.diffRunning(g.FormParams.Payload.BuildParameters["phid"], int(diff)) {
+		l.Printf("Another build of diff %d is running.  Leaving its staging branch and tag", diff)
+		return
+	}
 	if err := g.parent.git.setupRepository(ctx, repoURI); err != nil {
 		logIfErr(l, err, "cannot setup repository")
 	}
 
 	logIfErr(l, g.parent.git.removeTag(ctx, repoDir, fmt.Sprintf("phabricator_diff_branch_%d", diff)), "Cannot remove branch %d", diff)
 	logIfErr(l, g.parent.git.removeTag(ctx, repoDir, g.FormParams.Payload.BuildParameters["staging_ref"]), "Cannot remove tag %d", diff)
-
-	return nil
 }
 
 func (g *circleCiMsg) LooksValid() bool {
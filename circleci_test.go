@@ -3,9 +3,14 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
 var exampleCirclePost = `{
@@ -195,3 +200,141 @@ and again`,
 	assert.Nil(t, diffResultTemplate.Execute(buf, e))
 	t.Log("*" + buf.String() + "*")
 }
+
+// fakeCI is a ciProvider that serves canned results
+type fakeCI struct {
+	tests         []circleTestResult
+	artifactFiles map[string]string
+	status        *buildStatus
+	canceled      []int
+}
+
+func (f *fakeCI) scheduleBuild(ctx context.Context, revision string, project string, tree string, buildParams map[string]string) (*buildResponse, error) {
+	return &buildResponse{BuildURL: "https://circleci.com/gh/" + project + "/1", BuildNum: 1}, nil
+}
+
+func (f *fakeCI) testResults(ctx context.Context, username string, project string, buildNum int) ([]circleTestResult, error) {
+	return f.tests, nil
+}
+
+func (f *fakeCI) buildStatus(ctx context.Context, username string, project string, buildNum int) (*buildStatus, error) {
+	return f.status, nil
+}
+
+func (f *fakeCI) cancelBuild(ctx context.Context, username string, project string, buildNum int) error {
+	f.canceled = append(f.canceled, buildNum)
+	return nil
+}
+
+func (f *fakeCI) artifacts(ctx context.Context, username string, project string, buildNum int) ([]ciArtifact, error) {
+	var ret []ciArtifact
+	for p := range f.artifactFiles {
+		ret = append(ret, ciArtifact{Path: p, URL: p})
+	}
+	return ret, nil
+}
+
+func (f *fakeCI) fetchArtifact(ctx context.Context, a ciArtifact) ([]byte, error) {
+	return []byte(f.artifactFiles[a.URL]), nil
+}
+
+func (f *fakeCI) forRepo(cfg repoConfig) ciProvider {
+	return f
+}
+
+func TestPopulateTestResultsDetails(t *testing.T) {
+	long := strings.Repeat("x", 1000)
+	short := "boom"
+	ci := &fakeCI{
+		tests: []circleTestResult{
+			{Name: "a", Result: "failure", Message: &long},
+			{Name: "b", Result: "failure", Message: &short},
+			{Name: "c", Result: "success"},
+		},
+	}
+	g := circleCiMsg{
+		parent: &circleManager{
+			configs: &repoConfigs{
+				Repositories: map[string]repoConfig{"ABC": {UnitDetailsLimit: 100}},
+			},
+		},
+	}
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+
+	_, units, err := g.populateTestResults(ctx, ci, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, long, units[0].Details)
+	assert.Equal(t, "boom", units[1].Details)
+	assert.Equal(t, "", units[2].Details)
+
+	g.FormParams.Payload.BuildParameters = map[string]string{"callsign": "ABC"}
+	_, units, err = g.populateTestResults(ctx, ci, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, long[:99]+"... (trimmed output)", units[0].Details)
+	assert.Equal(t, unitFail, units[0].Result)
+}
+
+func TestCleanupKeepsRestartedDiff(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	builds := newBuildTracker()
+	builds.start(ctx, trackedBuild{TargetPHID: "PHID-1", Diff: 10, Revision: 5})
+	old, _ := builds.start(ctx, trackedBuild{TargetPHID: "PHID-2", Diff: 10, Revision: 5})
+	assert.Equal(t, "PHID-1", old.TargetPHID)
+
+	// The canceled build of the diff leaves the staging branch and tag to the new one
+	buf := &bytes.Buffer{}
+	g := circleCiMsg{parent: &circleManager{builds: builds, git: &githubPusher{tmpDir: "/does/not/exist"}}}
+	g.FormParams.Payload.BuildParameters = map[string]string{"phid": "PHID-1"}
+	g.cleanup(setLog(ctx, log.New(buf, "", 0)), "git@github.com:signalfx/arepo.git", "arepo", 10)
+	assert.Contains(t, buf.String(), "Leaving its staging branch and tag")
+	assert.NotContains(t, buf.String(), "cannot")
+
+	// Once the new build finishes, nothing else needs them
+	assert.True(t, builds.diffRunning("PHID-1", 10))
+	builds.markFinished(ctx, "PHID-2", "success")
+	assert.False(t, builds.diffRunning("PHID-2", 10))
+	assert.False(t, builds.diffRunning("PHID-1", 10))
+}
+
+func TestCallsignFromBuildRecord(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	builds := newBuildTracker()
+	builds.start(ctx, trackedBuild{TargetPHID: "PHID-1", Callsign: "ABC"})
+	g := circleCiMsg{parent: &circleManager{builds: builds}}
+
+	g.FormParams.Payload.BuildParameters = map[string]string{"phid": "PHID-1"}
+	assert.Equal(t, "ABC", g.callsign())
+	g.FormParams.Payload.BuildParameters["callsign"] = "XYZ"
+	assert.Equal(t, "XYZ", g.callsign())
+	g.FormParams.Payload.BuildParameters = map[string]string{"phid": "PHID-unknown"}
+	assert.Equal(t, "", g.callsign())
+}
+
+func TestResultsProvider(t *testing.T) {
+	v1 := &fakeCI{}
+	v2 := &fakeCI{}
+	g := circleCiMsg{
+		parent: &circleManager{
+			ci: &ciRegistry{
+				configs: &repoConfigs{
+					Repositories: map[string]repoConfig{"ABC": {CI: circleV2Provider}},
+				},
+				providers: map[string]ciProvider{defaultCIProvider: v1, circleV2Provider: v2},
+			},
+		},
+	}
+	g.FormParams.Payload.BuildParameters = map[string]string{"callsign": "ABC"}
+	ci, err := g.ci()
+	assert.Nil(t, err)
+	assert.True(t, ci == v2)
+
+	g.FormParams.Payload.BuildParameters["callsign"] = "XYZ"
+	ci, err = g.ci()
+	assert.Nil(t, err)
+	assert.True(t, ci == v1)
+
+	g.provider = v2
+	ci, err = g.ci()
+	assert.Nil(t, err)
+	assert.True(t, ci == v2)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// circleV2Manager handles CircleCI v2 webhooks for pipelines the bridge triggered.  Results are
+// always read through client, whatever the repository config says now.
+type circleV2Manager struct {
+	results *circleManager
+	client  *circleV2Client
+}
+
+// circleV2Msg is a CircleCI v2 "workflow-completed" webhook
+type circleV2Msg struct {
+	FormParams circleV2Event `json:"formparams"`
+
+	originalMsg *message
+	parent      *circleV2Manager
+}
+
+type circleV2Event struct {
+	Type     string `json:"type"`
+	Workflow struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Status string `json:"status"`
+		URL    string `json:"url"`
+	} `json:"workflow"`
+	Pipeline struct {
+		ID     string `json:"id"`
+		Number int    `json:"number"`
+	} `json:"pipeline"`
+	Project struct {
+		Slug string `json:"slug"`
+	} `json:"project"`
+}
+
+func (g *circleV2Msg) logFields() map[string]interface{} {
+	return map[string]interface{}{
+		"repository": g.FormParams.Project.Slug,
+		"build_num":  g.FormParams.Pipeline.Number,
+	}
+}
+
+func (c *circleV2Manager) parseCircleCIv2msg(msg *message) (parsedMessage, error) {
+	g := circleV2Msg{
+		originalMsg: msg,
+		parent:      c,
+	}
+	err := json.Unmarshal([]byte(msg.Body), &g)
+	if err != nil {
+		return nil, err
+	}
+	if g.LooksValid() {
+		return &g, nil
+	}
+	return nil, errNotValidMessageType
+}
+
+func (g *circleV2Msg) OriginalMsg() *message {
+	return g.originalMsg
+}
+
+// SerializationKey is the pipeline, since every workflow of a pipeline sends a webhook.  Run
+// concurrently, two of them could each see the other still running and neither would publish, or
+// both could see every workflow finished and publish twice.
+func (g *circleV2Msg) SerializationKey() string {
+	return g.FormParams.Pipeline.ID
+}
+
+func (g *circleV2Msg) LooksValid() bool {
+	return g.FormParams.Type == "workflow-completed" && g.FormParams.Pipeline.ID != "" && len(strings.Split(g.FormParams.Project.Slug, "/")) == 3
+}
+
+// pipelineParams reads the parameters the bridge triggered the pipeline with
+func pipelineParams(p *circleV2Pipeline) map[string]string {
+	ret := make(map[string]string, len(circleV2PipelineParams))
+	sources := []map[string]interface{}{p.TriggerParameters}
+	if nested, ok := p.TriggerParameters["parameters"].(map[string]interface{}); ok {
+		sources = append(sources, nested)
+	}
+	for _, src := range sources {
+		for _, name := range circleV2PipelineParams {
+			if v, exists := src[name]; exists && v != nil {
+				ret[name] = fmt.Sprintf("%v", v)
+			}
+		}
+	}
+	return ret
+}
+
+func pipelineDuration(workflows []circleV2Workflow) time.Duration {
+	var start, stop time.Time
+	for _, w := range workflows {
+		if w.CreatedAt != nil && (start.IsZero() || w.CreatedAt.Before(start)) {
+			start = *w.CreatedAt
+		}
+		if w.StoppedAt != nil && w.StoppedAt.After(stop) {
+			stop = *w.StoppedAt
+		}
+	}
+	if start.IsZero() || stop.Before(start) {
+		return 0
+	}
+	return stop.Sub(start)
+}
+
+// Execute waits for the last workflow of the pipeline to complete, then publishes the results of
+// the whole pipeline the same way a v1 build is published
+func (g *circleV2Msg) Execute(ctx context.Context) error {
+	l := getLog(ctx)
+	slug := g.FormParams.Project.Slug
+	l.Printf("Executing circleCI v2 command for pipeline %s of %s", g.FormParams.Pipeline.ID, slug)
+	p, err := g.parent.client.pipeline(ctx, g.FormParams.Pipeline.ID)
+	if err != nil {
+		return err
+	}
+	params := pipelineParams(p)
+	if params["phid"] == "" {
+		l.Printf("circleci pipeline isn't a phab attempt: %s", p.ID)
+		return nil
+	}
+	workflows, err := g.parent.client.workflows(ctx, p.ID)
+	if err != nil {
+		return err
+	}
+	status := workflowsStatus(slug, p.Number, workflows)
+	if !status.finished() {
+		l.Printf("Pipeline %s still has running workflows.  Waiting for the last one", p.ID)
+		return nil
+	}
+	parts := strings.Split(slug, "/")
+	results := &circleCiMsg{
+		FormParams: circleMsg{
+			Payload: circleCiPayload{
+				BuildURL:        status.BuildURL,
+				Outcome:         status.Outcome,
+				BuildTimeMS:     int(pipelineDuration(workflows) / time.Millisecond),
+				Username:        parts[1],
+				Reponame:        parts[2],
+				BuildNum:        p.Number,
+				BuildParameters: params,
+			},
+		},
+		originalMsg: g.originalMsg,
+		parent:      g.parent.results,
+		provider:    g.parent.client.forVCS(parts[0]),
+	}
+	ctx = setLog(ctx, withLogFields(l, results.logFields()))
+	return results.publishResults(ctx)
+}
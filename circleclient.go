@@ -7,13 +7,33 @@ import (
 	"golang.org/x/net/context"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
+// ciProvider is a CI system the bridge can schedule builds on and read results from
+type ciProvider interface {
+	scheduleBuild(ctx context.Context, revision string, project string, tree string, buildParams map[string]string) (*buildResponse, error)
+	testResults(ctx context.Context, username string, project string, buildNum int) ([]circleTestResult, error)
+	buildStatus(ctx context.Context, username string, project string, buildNum int) (*buildStatus, error)
+	cancelBuild(ctx context.Context, username string, project string, buildNum int) error
+	artifacts(ctx context.Context, username string, project string, buildNum int) ([]ciArtifact, error)
+	fetchArtifact(ctx context.Context, a ciArtifact) ([]byte, error)
+	// forRepo returns the provider to use for a repository with the given settings
+	forRepo(cfg repoConfig) ciProvider
+}
+
+const circleV1BaseURL = "https://circleci.com/api/v1"
+
 type circleClient struct {
-	token  string
-	client http.Client
+	token   string
+	baseURL string
+	client  http.Client
 }
 
+var _ ciProvider = &circleClient{}
+
 type scheduledBuild struct {
 	Revision    string            `json:"revision"`
 	BuildParams map[string]string `json:"build_parameters"`
@@ -21,6 +41,25 @@ type scheduledBuild struct {
 
 type buildResponse struct {
 	BuildURL string `json:"build_url"`
+	BuildNum int    `json:"build_num"`
+}
+
+type buildStatus struct {
+	BuildURL  string `json:"build_url"`
+	BuildNum  int    `json:"build_num"`
+	Lifecycle string `json:"lifecycle"`
+	Outcome   string `json:"outcome"`
+	Status    string `json:"status"`
+}
+
+// running is true while the build runs, after it was queued
+func (b *buildStatus) running() bool {
+	return b.Lifecycle == "running"
+}
+
+// finished is true once the build will not change state again
+func (b *buildStatus) finished() bool {
+	return b.Lifecycle == "finished"
 }
 
 type circleTestResult struct {
@@ -38,64 +77,167 @@ type circleTestGetResp struct {
 	Tests []circleTestResult `json:"tests"`
 }
 
-func (c *circleClient) testResults(ctx context.Context, username string, project string, buildNum int) ([]circleTestResult, error) {
-	url := fmt.Sprintf("https://circleci.com/api/v1/project/%s/%s/%d/tests?circle-token=%s", username, project, buildNum, c.token)
-	req, err := http.NewRequest("GET", url, nil)
+func (c *circleClient) url(format string, args ...interface{}) string {
+	base := c.baseURL
+	if base == "" {
+		base = circleV1BaseURL
+	}
+	return base + fmt.Sprintf(format, args...)
+}
+
+func (c *circleClient) doJSON(ctx context.Context, method string, url string, body interface{}, expectedStatus int, into interface{}) error {
+	return doJSON(ctx, &c.client, method, url, circleTokenHeader(c.token), body, expectedStatus, into)
+}
+
+// circleTokenHeader authenticates to CircleCI without putting the token in a URL that may be logged
+func circleTokenHeader(token string) http.Header {
+	header := http.Header{}
+	header.Set("Circle-Token", token)
+	return header
+}
+
+// circleTokenHosts are the domains, besides the API's own host, that may be sent the CircleCI
+// token.  Artifacts are served from subdomains of circle-artifacts.com.
+var circleTokenHosts = []string{"circleci.com", "circle-artifacts.com"}
+
+// artifactHeader authenticates an artifact download only if the artifact is hosted by CircleCI,
+// so a build cannot point the bridge at a URL that collects the token
+func artifactHeader(token string, baseURL string, artifactURL string) http.Header {
+	u, err := url.Parse(artifactURL)
 	if err != nil {
-		return nil, wraperr(err, "cannot get req for url %s", url)
+		return http.Header{}
+	}
+	host := u.Hostname()
+	if base, err := url.Parse(baseURL); err == nil && base.Host == u.Host {
+		return circleTokenHeader(token)
+	}
+	for _, trusted := range circleTokenHosts {
+		if host == trusted || strings.HasSuffix(host, "."+trusted) {
+			return circleTokenHeader(token)
+		}
+	}
+	return http.Header{}
+}
+
+// maxResponseBytes caps how much of a response, such as a build artifact, is read into memory
+const maxResponseBytes = 64 << 20
+
+// doJSON sends body, if any, as JSON and decodes the response into into, if any
+func doJSON(ctx context.Context, client *http.Client, method string, url string, header http.Header, body interface{}, expectedStatus int, into interface{}) error {
+	var reqBody io.Reader
+	reqHeader := http.Header{}
+	for k, vals := range header {
+		reqHeader[k] = vals
+	}
+	if body != nil {
+		buf := &bytes.Buffer{}
+		if err := json.NewEncoder(buf).Encode(body); err != nil {
+			return wraperr(err, "cannot encode request JSON")
+		}
+		getLog(ctx).Printf("Body: %s", buf.String())
+		reqBody = buf
+		reqHeader.Add("Content-Type", "application/json")
 	}
-	req.Header.Add("Accept", "application/json")
-	resp, err := c.client.Do(req)
+	reqHeader.Add("Accept", "application/json")
+	respBody, err := doRequest(ctx, client, method, url, reqHeader, reqBody, expectedStatus)
 	if err != nil {
-		return nil, wraperr(err, "cannot GET request %s", url)
+		return err
+	}
+	if into == nil {
+		return nil
+	}
+	if err := json.NewDecoder(bytes.NewReader(respBody)).Decode(into); err != nil {
+		return wraperr(err, "cannot decode JSON body")
+	}
+	return nil
+}
+
+// doRequest returns the body of the response, which must have expectedStatus
+func doRequest(ctx context.Context, client *http.Client, method string, url string, header http.Header, body io.Reader, expectedStatus int) ([]byte, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, wraperr(err, "cannot make request to %s", url)
+	}
+	for k, vals := range header {
+		for _, v := range vals {
+			req.Header.Add(k, v)
+		}
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	metrics.circleLatency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	metrics.circleCalls.WithLabelValues(method, statusCode(resp)).Inc()
+	if err != nil {
+		return nil, wraperr(err, "cannot %s request %s", method, url)
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != expectedStatus {
 		getLog(ctx).Printf("Invalid status %d", resp.StatusCode)
-		return nil, fmt.Errorf("non 200 response %d on %s", resp.StatusCode, url)
+		return nil, fmt.Errorf("non %d response %d on %s", expectedStatus, resp.StatusCode, url)
 	}
 	fullBody := bytes.Buffer{}
-	_, err = io.Copy(&fullBody, resp.Body)
-	if err != nil {
+	if _, err := io.Copy(&fullBody, io.LimitReader(resp.Body, maxResponseBytes)); err != nil {
 		return nil, wraperr(err, "cannot copy msg out of http body")
 	}
+	return fullBody.Bytes(), nil
+}
+
+// me checks CircleCI accepts the token
+func (c *circleClient) me(ctx context.Context) error {
+	return c.doJSON(ctx, "GET", c.url("/me"), nil, http.StatusOK, nil)
+}
+
+func (c *circleClient) testResults(ctx context.Context, username string, project string, buildNum int) ([]circleTestResult, error) {
+	url := c.url("/project/%s/%s/%d/tests", username, project, buildNum)
 	var r circleTestGetResp
-	if err := json.NewDecoder(&fullBody).Decode(&r); err != nil {
-		return nil, wraperr(err, "cannot decode JSON body")
+	if err := c.doJSON(ctx, "GET", url, nil, http.StatusOK, &r); err != nil {
+		return nil, err
 	}
 	return r.Tests, nil
 }
 
 func (c *circleClient) scheduleBuild(ctx context.Context, revision string, project string, tree string, buildParams map[string]string) (*buildResponse, error) {
-	url := fmt.Sprintf("https://circleci.com/api/v1/project/%s/tree/%s?circle-token=%s", project, tree, c.token)
+	url := c.url("/project/%s/tree/%s", project, tree)
 	b := &scheduledBuild{
 		Revision:    revision,
 		BuildParams: buildParams,
 	}
-	body := bytes.Buffer{}
-	if err := json.NewEncoder(&body).Encode(b); err != nil {
-		return nil, wraperr(err, "cannot encode build JSON")
-	}
-	getLog(ctx).Printf("Body: %s", body.String())
-	req, err := http.NewRequest("POST", url, &body)
-	if err != nil {
-		return nil, wraperr(err, "cannot make request to %s", url)
-	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Accept", "application/json")
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return nil, wraperr(err, "cannot POST request to %s", url)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusCreated {
+	respBody := buildResponse{}
+	if err := c.doJSON(ctx, "POST", url, b, http.StatusCreated, &respBody); err != nil {
 		getLog(ctx).Printf("Build params %v", buildParams)
-		return nil, fmt.Errorf("non 201 response %d on %s", resp.StatusCode, url)
+		return nil, err
 	}
+	return &respBody, nil
+}
 
-	respBody := buildResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
-		return nil, wraperr(err, "response body does not look like JSON")
+func (c *circleClient) buildStatus(ctx context.Context, username string, project string, buildNum int) (*buildStatus, error) {
+	url := c.url("/project/%s/%s/%d", username, project, buildNum)
+	ret := buildStatus{}
+	if err := c.doJSON(ctx, "GET", url, nil, http.StatusOK, &ret); err != nil {
+		return nil, err
 	}
-	return &respBody, nil
+	return &ret, nil
+}
+
+func (c *circleClient) cancelBuild(ctx context.Context, username string, project string, buildNum int) error {
+	url := c.url("/project/%s/%s/%d/cancel", username, project, buildNum)
+	return c.doJSON(ctx, "POST", url, nil, http.StatusOK, nil)
+}
+
+func (c *circleClient) artifacts(ctx context.Context, username string, project string, buildNum int) ([]ciArtifact, error) {
+	url := c.url("/project/%s/%s/%d/artifacts", username, project, buildNum)
+	var ret []ciArtifact
+	if err := c.doJSON(ctx, "GET", url, nil, http.StatusOK, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *circleClient) fetchArtifact(ctx context.Context, a ciArtifact) ([]byte, error) {
+	return doRequest(ctx, &c.client, "GET", a.URL, artifactHeader(c.token, c.url(""), a.URL), nil, http.StatusOK)
+}
+
+// forRepo returns c, since the v1 API needs no per repository settings
+func (c *circleClient) forRepo(cfg repoConfig) ciProvider {
+	return c
 }
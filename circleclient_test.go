@@ -2,7 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
 var response = `{
@@ -89,3 +97,36 @@ func TestParsingCircleClient(t *testing.T) {
 		t.Errorf("Cannot parse json: %s", err.Error())
 	}
 }
+
+func TestCircleClientTokenInHeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "secret", req.Header.Get("Circle-Token"))
+		assert.Equal(t, "", req.URL.RawQuery)
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	c := circleClient{
+		token:   "secret",
+		baseURL: server.URL,
+	}
+	_, err := c.testResults(ctx, "signalfx", "arepo", 12)
+	assert.NotNil(t, err)
+	assert.False(t, strings.Contains(err.Error(), "secret"))
+}
+
+func TestArtifactHeader(t *testing.T) {
+	base := "http://127.0.0.1:1234/api/v1"
+	for artifactURL, sendsToken := range map[string]bool{
+		"https://123-456-gh.circle-artifacts.com/0/lint.json":        true,
+		"https://output.circle-artifacts.com/output/job/x/lint.json": true,
+		"https://circleci.com/api/v1.1/project/gh/a/b/1/artifacts/0": true,
+		"http://127.0.0.1:1234/artifacts/lint.json":                  true,
+		"https://evil.example.com/lint.json":                         false,
+		"https://circle-artifacts.com.evil.example.com/lint.json":    false,
+		"http://127.0.0.1:9999/lint.json":                            false,
+		"::not a url":                                                false,
+	} {
+		assert.Equal(t, sendsToken, artifactHeader("token", base, artifactURL).Get("Circle-Token") == "token", artifactURL)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	circleV2Provider = "circleci-v2"
+	circleV2BaseURL  = "https://circleci.com/api/v2"
+	circleV2AppURL   = "https://app.circleci.com/pipelines"
+	// defaultVCS is the VCS type in the project slug of repositories that do not configure one
+	defaultVCS = "gh"
+)
+
+// circleV2PipelineParams are the Harbormaster parameters passed to a v2 pipeline.  Each must be
+// declared as a string parameter in the project's .circleci/config.yml.
+var circleV2PipelineParams = []string{"diff", "revision", "phid", "staging_ref", "staging_uri"}
+
+// circleV2Client is a ciProvider for the CircleCI v2 API.  A "build" is a pipeline, identified by
+// its pipeline number, and results are aggregated across every workflow and job in it.
+type circleV2Client struct {
+	token   string
+	baseURL string
+	// vcs is the VCS type the project slugs start with, such as gh or bb
+	vcs    string
+	client http.Client
+}
+
+var _ ciProvider = &circleV2Client{}
+
+type circleV2Pipeline struct {
+	ID                string                 `json:"id"`
+	Number            int                    `json:"number"`
+	State             string                 `json:"state"`
+	ProjectSlug       string                 `json:"project_slug"`
+	TriggerParameters map[string]interface{} `json:"trigger_parameters"`
+}
+
+type circleV2Workflow struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Status    string     `json:"status"`
+	CreatedAt *time.Time `json:"created_at"`
+	StoppedAt *time.Time `json:"stopped_at"`
+}
+
+type circleV2Job struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	JobNumber *int   `json:"job_number"`
+}
+
+type circleV2Page struct {
+	NextPageToken *string `json:"next_page_token"`
+}
+
+type circleV2TriggerPipeline struct {
+	Branch     string            `json:"branch,omitempty"`
+	Tag        string            `json:"tag,omitempty"`
+	Parameters map[string]string `json:"parameters"`
+}
+
+// forVCS returns a client for projects hosted on vcs.  It shares the HTTP client.
+func (c *circleV2Client) forVCS(vcs string) *circleV2Client {
+	ret := *c
+	ret.vcs = vcs
+	return &ret
+}
+
+func (c *circleV2Client) slug(project string) string {
+	vcs := c.vcs
+	if vcs == "" {
+		vcs = defaultVCS
+	}
+	return vcs + "/" + project
+}
+
+func (c *circleV2Client) projectSlug(username string, project string) string {
+	return c.slug(username + "/" + project)
+}
+
+func circleV2PipelineURL(slug string, number int) string {
+	return fmt.Sprintf("%s/%s/%d", circleV2AppURL, slug, number)
+}
+
+// workflowFinished is true for workflow states that will never change again
+func workflowFinished(status string) bool {
+	switch status {
+	case "success", "failed", "error", "canceled", "not_run", "unauthorized":
+		return true
+	}
+	return false
+}
+
+func (c *circleV2Client) url(format string, args ...interface{}) string {
+	base := c.baseURL
+	if base == "" {
+		base = circleV2BaseURL
+	}
+	return base + fmt.Sprintf(format, args...)
+}
+
+func (c *circleV2Client) doJSON(ctx context.Context, method string, url string, body interface{}, expectedStatus int, into interface{}) error {
+	return doJSON(ctx, &c.client, method, url, circleTokenHeader(c.token), body, expectedStatus, into)
+}
+
+// paginate calls fetch with each page token until CircleCI stops returning one
+func (c *circleV2Client) paginate(ctx context.Context, baseURL string, fetch func(url string) (*string, error)) error {
+	pageURL := baseURL
+	for {
+		next, err := fetch(pageURL)
+		if err != nil {
+			return err
+		}
+		if next == nil || *next == "" {
+			return nil
+		}
+		pageURL = baseURL + "?page-token=" + url.QueryEscape(*next)
+	}
+}
+
+func (c *circleV2Client) scheduleBuild(ctx context.Context, revision string, project string, tree string, buildParams map[string]string) (*buildResponse, error) {
+	slug := c.slug(project)
+	b := circleV2TriggerPipeline{
+		Branch:     tree,
+		Parameters: make(map[string]string, len(circleV2PipelineParams)),
+	}
+	// v2 cannot build an arbitrary revision, but the staging area tags every diff
+	if strings.HasPrefix(revision, "refs/tags/") {
+		b.Branch = ""
+		b.Tag = strings.TrimPrefix(revision, "refs/tags/")
+	}
+	for _, p := range circleV2PipelineParams {
+		b.Parameters[p] = buildParams[p]
+	}
+	var p circleV2Pipeline
+	if err := c.doJSON(ctx, "POST", c.url("/project/%s/pipeline", slug), &b, http.StatusCreated, &p); err != nil {
+		return nil, err
+	}
+	return &buildResponse{
+		BuildURL: circleV2PipelineURL(slug, p.Number),
+		BuildNum: p.Number,
+	}, nil
+}
+
+func (c *circleV2Client) pipelineByNumber(ctx context.Context, slug string, number int) (*circleV2Pipeline, error) {
+	var p circleV2Pipeline
+	if err := c.doJSON(ctx, "GET", c.url("/project/%s/pipeline/%d", slug, number), nil, http.StatusOK, &p); err != nil {
+		return nil, wraperr(err, "cannot get pipeline %d of %s", number, slug)
+	}
+	return &p, nil
+}
+
+func (c *circleV2Client) pipeline(ctx context.Context, id string) (*circleV2Pipeline, error) {
+	var p circleV2Pipeline
+	if err := c.doJSON(ctx, "GET", c.url("/pipeline/%s", id), nil, http.StatusOK, &p); err != nil {
+		return nil, wraperr(err, "cannot get pipeline %s", id)
+	}
+	return &p, nil
+}
+
+func (c *circleV2Client) workflows(ctx context.Context, pipelineID string) ([]circleV2Workflow, error) {
+	var ret []circleV2Workflow
+	err := c.paginate(ctx, c.url("/pipeline/%s/workflow", pipelineID), func(url string) (*string, error) {
+		var page struct {
+			circleV2Page
+			Items []circleV2Workflow `json:"items"`
+		}
+		if err := c.doJSON(ctx, "GET", url, nil, http.StatusOK, &page); err != nil {
+			return nil, wraperr(err, "cannot list workflows of pipeline %s", pipelineID)
+		}
+		ret = append(ret, page.Items...)
+		return page.NextPageToken, nil
+	})
+	return ret, err
+}
+
+func (c *circleV2Client) jobs(ctx context.Context, workflowID string) ([]circleV2Job, error) {
+	var ret []circleV2Job
+	err := c.paginate(ctx, c.url("/workflow/%s/job", workflowID), func(url string) (*string, error) {
+		var page struct {
+			circleV2Page
+			Items []circleV2Job `json:"items"`
+		}
+		if err := c.doJSON(ctx, "GET", url, nil, http.StatusOK, &page); err != nil {
+			return nil, wraperr(err, "cannot list jobs of workflow %s", workflowID)
+		}
+		ret = append(ret, page.Items...)
+		return page.NextPageToken, nil
+	})
+	return ret, err
+}
+
+func (c *circleV2Client) jobTests(ctx context.Context, slug string, jobNumber int) ([]circleTestResult, error) {
+	var ret []circleTestResult
+	err := c.paginate(ctx, c.url("/project/%s/%d/tests", slug, jobNumber), func(url string) (*string, error) {
+		var page struct {
+			circleV2Page
+			Items []circleTestResult `json:"items"`
+		}
+		if err := c.doJSON(ctx, "GET", url, nil, http.StatusOK, &page); err != nil {
+			return nil, wraperr(err, "cannot list tests of job %d", jobNumber)
+		}
+		ret = append(ret, page.Items...)
+		return page.NextPageToken, nil
+	})
+	return ret, err
+}
+
+// eachJob calls fn with the number of every job, in every workflow, of the pipeline
+func (c *circleV2Client) eachJob(ctx context.Context, slug string, buildNum int, fn func(jobNumber int) error) error {
+	p, err := c.pipelineByNumber(ctx, slug, buildNum)
+	if err != nil {
+		return err
+	}
+	workflows, err := c.workflows(ctx, p.ID)
+	if err != nil {
+		return err
+	}
+	for _, w := range workflows {
+		jobs, err := c.jobs(ctx, w.ID)
+		if err != nil {
+			return err
+		}
+		for _, j := range jobs {
+			// Approval jobs have no number, tests or artifacts
+			if j.JobNumber == nil {
+				continue
+			}
+			if err := fn(*j.JobNumber); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// testResults aggregates the tests of every job in every workflow of the pipeline
+func (c *circleV2Client) testResults(ctx context.Context, username string, project string, buildNum int) ([]circleTestResult, error) {
+	slug := c.projectSlug(username, project)
+	var ret []circleTestResult
+	err := c.eachJob(ctx, slug, buildNum, func(jobNumber int) error {
+		tests, err := c.jobTests(ctx, slug, jobNumber)
+		ret = append(ret, tests...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// artifacts aggregates the artifacts of every job in every workflow of the pipeline
+func (c *circleV2Client) artifacts(ctx context.Context, username string, project string, buildNum int) ([]ciArtifact, error) {
+	slug := c.projectSlug(username, project)
+	var ret []ciArtifact
+	err := c.eachJob(ctx, slug, buildNum, func(jobNumber int) error {
+		return c.paginate(ctx, c.url("/project/%s/%d/artifacts", slug, jobNumber), func(url string) (*string, error) {
+			var page struct {
+				circleV2Page
+				Items []ciArtifact `json:"items"`
+			}
+			if err := c.doJSON(ctx, "GET", url, nil, http.StatusOK, &page); err != nil {
+				return nil, wraperr(err, "cannot list artifacts of job %d", jobNumber)
+			}
+			ret = append(ret, page.Items...)
+			return page.NextPageToken, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *circleV2Client) fetchArtifact(ctx context.Context, a ciArtifact) ([]byte, error) {
+	return doRequest(ctx, &c.client, "GET", a.URL, artifactHeader(c.token, c.url(""), a.URL), nil, http.StatusOK)
+}
+
+// forRepo returns a client for the repository's VCS, which is part of every project slug
+func (c *circleV2Client) forRepo(cfg repoConfig) ciProvider {
+	return c.forVCS(cfg.VCS)
+}
+
+// workflowsStatus folds the state of every workflow into a single v1 style build status
+func workflowsStatus(slug string, number int, workflows []circleV2Workflow) *buildStatus {
+	ret := &buildStatus{
+		BuildURL:  circleV2PipelineURL(slug, number),
+		BuildNum:  number,
+		Lifecycle: "finished",
+		Outcome:   "success",
+	}
+	for _, w := range workflows {
+		if !workflowFinished(w.Status) {
+			ret.Lifecycle = "running"
+		}
+		switch w.Status {
+		case "failed", "error", "failing", "unauthorized":
+			ret.Outcome = "failed"
+		case "canceled":
+			if ret.Outcome != "failed" {
+				ret.Outcome = "canceled"
+			}
+		}
+	}
+	if ret.Lifecycle != "finished" {
+		ret.Outcome = ""
+	}
+	ret.Status = ret.Outcome
+	return ret
+}
+
+func (c *circleV2Client) buildStatus(ctx context.Context, username string, project string, buildNum int) (*buildStatus, error) {
+	slug := c.projectSlug(username, project)
+	p, err := c.pipelineByNumber(ctx, slug, buildNum)
+	if err != nil {
+		return nil, err
+	}
+	workflows, err := c.workflows(ctx, p.ID)
+	if err != nil {
+		return nil, err
+	}
+	return workflowsStatus(slug, buildNum, workflows), nil
+}
+
+// cancelBuild cancels every workflow of the pipeline that is still running
+func (c *circleV2Client) cancelBuild(ctx context.Context, username string, project string, buildNum int) error {
+	slug := c.projectSlug(username, project)
+	p, err := c.pipelineByNumber(ctx, slug, buildNum)
+	if err != nil {
+		return err
+	}
+	workflows, err := c.workflows(ctx, p.ID)
+	if err != nil {
+		return err
+	}
+	for _, w := range workflows {
+		if workflowFinished(w.Status) {
+			continue
+		}
+		if err := c.doJSON(ctx, "POST", c.url("/workflow/%s/cancel", w.ID), nil, http.StatusAccepted, nil); err != nil {
+			return wraperr(err, "cannot cancel workflow %s", w.ID)
+		}
+	}
+	return nil
+}
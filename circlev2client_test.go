@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func newCircleV2TestServer(t *testing.T) (*httptest.Server, *circleV2TriggerPipeline) {
+	triggered := &circleV2TriggerPipeline{}
+	mux := http.NewServeMux()
+	reply := func(path string, body string) {
+		mux.HandleFunc(path, func(rw http.ResponseWriter, req *http.Request) {
+			assert.Equal(t, "token", req.Header.Get("Circle-Token"))
+			rw.Write([]byte(body))
+		})
+	}
+	mux.HandleFunc("/project/gh/signalfx/arepo/pipeline", func(rw http.ResponseWriter, req *http.Request) {
+		assert.Nil(t, json.NewDecoder(req.Body).Decode(triggered))
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write([]byte(`{"id": "pipe-1", "number": 7, "state": "created"}`))
+	})
+	reply("/project/gh/signalfx/arepo/pipeline/7", `{"id": "pipe-1", "number": 7}`)
+	mux.HandleFunc("/pipeline/pipe-1/workflow", func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("page-token") == "" {
+			rw.Write([]byte(`{"items": [{"id": "wf-1", "status": "success"}], "next_page_token": "p2"}`))
+			return
+		}
+		rw.Write([]byte(`{"items": [{"id": "wf-2", "status": "failed"}], "next_page_token": null}`))
+	})
+	reply("/workflow/wf-1/job", `{"items": [{"id": "j1", "job_number": 11}, {"id": "approve"}]}`)
+	reply("/workflow/wf-2/job", `{"items": [{"id": "j2", "job_number": 12}]}`)
+	reply("/project/gh/signalfx/arepo/11/tests", `{"items": [{"name": "a", "classname": "A", "result": "success"}]}`)
+	reply("/project/gh/signalfx/arepo/12/tests", `{"items": [{"name": "b", "classname": "B", "result": "failure"}, {"name": "c", "classname": "B", "result": "success"}]}`)
+	return httptest.NewServer(mux), triggered
+}
+
+func TestCircleV2Client(t *testing.T) {
+	server, triggered := newCircleV2TestServer(t)
+	defer server.Close()
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	c := circleV2Client{
+		token:   "token",
+		baseURL: server.URL,
+	}
+
+	resp, err := c.scheduleBuild(ctx, "refs/tags/phabricator/diff/12", "signalfx/arepo", "phabricator_test_ABC", map[string]string{"diff": "12", "phid": "PHID-1", "callsign": "ABC", "other": "x"})
+	assert.Nil(t, err)
+	assert.Equal(t, 7, resp.BuildNum)
+	assert.Equal(t, "https://app.circleci.com/pipelines/gh/signalfx/arepo/7", resp.BuildURL)
+	assert.Equal(t, "phabricator/diff/12", triggered.Tag)
+	assert.Equal(t, "", triggered.Branch)
+	assert.Equal(t, "PHID-1", triggered.Parameters["phid"])
+	_, hasCallsign := triggered.Parameters["callsign"]
+	assert.False(t, hasCallsign)
+	_, hasOther := triggered.Parameters["other"]
+	assert.False(t, hasOther)
+
+	tests, err := c.testResults(ctx, "signalfx", "arepo", 7)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(tests))
+
+	status, err := c.buildStatus(ctx, "signalfx", "arepo", 7)
+	assert.Nil(t, err)
+	assert.True(t, status.finished())
+	assert.Equal(t, "failed", status.Outcome)
+}
+
+func TestWorkflowsStatus(t *testing.T) {
+	s := workflowsStatus("gh/a/b", 1, []circleV2Workflow{{Status: "success"}, {Status: "running"}})
+	assert.False(t, s.finished())
+	s = workflowsStatus("gh/a/b", 1, []circleV2Workflow{{Status: "success"}, {Status: "canceled"}})
+	assert.True(t, s.finished())
+	assert.Equal(t, "canceled", s.Outcome)
+}
+
+func TestParseCircleV2Msg(t *testing.T) {
+	c := circleV2Manager{}
+	m, err := c.parseCircleCIv2msg(&message{Body: `{"formparams": {"type": "workflow-completed", "pipeline": {"id": "pipe-1", "number": 7}, "project": {"slug": "gh/signalfx/arepo"}}}`})
+	assert.Nil(t, err)
+	assert.Equal(t, "pipe-1", m.SerializationKey())
+	_, err = c.parseCircleCIv2msg(&message{Body: exampleCirclePost})
+	assert.Equal(t, errNotValidMessageType, err)
+
+	params := pipelineParams(&circleV2Pipeline{TriggerParameters: map[string]interface{}{
+		"parameters": map[string]interface{}{"diff": 12, "phid": "PHID-1"},
+	}})
+	assert.Equal(t, "12", params["diff"])
+	assert.Equal(t, "PHID-1", params["phid"])
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+// commentTemplateFuncs are available to every result comment template
+var commentTemplateFuncs = template.FuncMap{
+	"trim": func(limit int, msg string) string {
+		return trimOutput(msg, limit)
+	},
+}
+
+// exampleDiffResult is what templates are run against at startup, so a template that reaches for
+// a field that does not exist fails before the first build does
+var exampleDiffResult = diffResultStruct{
+	BuildResult:  "failed",
+	BuildTime:    time.Minute,
+	BuildURL:     "https://circleci.com/gh/example/example/1",
+	TestCount:    2,
+	FailingTests: 1,
+	PassingTests: 1,
+	BuildNumber:  1,
+	Tests: []diffResultTestStruct{
+		{Classname: "example", TestName: "TestFails", Result: "failure", Duration: time.Second, Message: "failed"},
+	},
+	AllTests: []diffResultTestStruct{
+		{Classname: "example", TestName: "TestFails", Result: "failure", Duration: time.Second, Message: "failed"},
+		{Classname: "example", TestName: "TestPasses", Result: "success", Duration: time.Second},
+	},
+	Artifacts: []ciArtifact{
+		{Path: "reports/junit.xml", URL: "https://circleci.com/artifacts/reports/junit.xml"},
+	},
+}
+
+// parseCommentTemplate reads a result comment template file and checks it renders
+func parseCommentTemplate(filename string) (*template.Template, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, wraperr(err, "cannot read comment template %s", filename)
+	}
+	t, err := template.New(filepath.Base(filename)).Funcs(commentTemplateFuncs).Parse(string(contents))
+	if err != nil {
+		return nil, wraperr(err, "cannot parse comment template %s", filename)
+	}
+	if err := t.Execute(ioutil.Discard, exampleDiffResult); err != nil {
+		return nil, wraperr(err, "comment template %s does not render", filename)
+	}
+	return t, nil
+}
+
+// loadCommentTemplates parses every template the config refers to.  Relative file names are
+// relative to the directory of the config file.
+func (r *repoConfigs) loadCommentTemplates(dir string) error {
+	r.commentTemplates = make(map[string]*template.Template)
+	configs := []repoConfig{r.Default}
+	for _, c := range r.Repositories {
+		configs = append(configs, c)
+	}
+	for _, c := range configs {
+		name := c.CommentTemplate
+		if name == "" {
+			continue
+		}
+		if _, exists := r.commentTemplates[name]; exists {
+			continue
+		}
+		filename := name
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(dir, filename)
+		}
+		t, err := parseCommentTemplate(filename)
+		if err != nil {
+			return err
+		}
+		r.commentTemplates[name] = t
+	}
+	return nil
+}
+
+// commentTemplate is the template for a repository's result comment, or diffResultTemplate when
+// none is configured
+func (r *repoConfigs) commentTemplate(callsign string) *template.Template {
+	if t, exists := r.commentTemplates[r.forCallsign(callsign).CommentTemplate]; exists {
+		return t
+	}
+	return diffResultTemplate
+}
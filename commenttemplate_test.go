@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommentTemplates(t *testing.T) {
+	tmpl := writeTempFile(t, `{{ .BuildResult }} {{ .BuildURL }}{{ range .AllTests }} {{ .TestName }}={{ .Result }}:{{ trim 4 .Message }}{{ end }}{{ range .Artifacts }} {{ .Path }}{{ end }}`)
+	defer os.Remove(tmpl)
+	filename := writeTempFile(t, `{"repositories": {"ABC": {"comment_template": "`+filepath.Base(tmpl)+`"}}}`)
+	defer os.Remove(filename)
+
+	configs, err := loadRepoConfigs(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, diffResultTemplate, configs.commentTemplate("XYZ"))
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, configs.commentTemplate("ABC").Execute(buf, exampleDiffResult))
+	assert.Equal(t, "failed https://circleci.com/gh/example/example/1 TestFails=failure:fai... (trimmed output) TestPasses=success: reports/junit.xml", buf.String())
+}
+
+func TestBadCommentTemplate(t *testing.T) {
+	for _, contents := range []string{"{{ .NoSuchField }}", "{{ if }}"} {
+		tmpl := writeTempFile(t, contents)
+		filename := writeTempFile(t, `{"default": {"comment_template": "`+tmpl+`"}}`)
+		_, err := loadRepoConfigs(filename)
+		assert.NotNil(t, err, contents)
+		os.Remove(tmpl)
+		os.Remove(filename)
+	}
+
+	filename := writeTempFile(t, `{"default": {"comment_template": "/does/not/exist.tmpl"}}`)
+	defer os.Remove(filename)
+	_, err := loadRepoConfigs(filename)
+	assert.NotNil(t, err)
+}
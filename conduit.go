@@ -1,20 +1,158 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"golang.org/x/net/context"
-	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
+	"time"
 )
 
 type phabricatorConduit struct {
 	apiToken string
 	url      *url.URL
 	client   http.Client
+	// secrets scrubs tokens out of text posted to Phabricator, such as test output and errors
+	secrets *redactor
+
+	// methods are the Conduit methods the install supports, probed once with conduit.query.  No
+	// probe starts before methodsRetry, so a failing one is not repeated on every call.
+	methodsMu    sync.Mutex
+	methods      map[string]struct{}
+	methodsRetry time.Time
+}
+
+// methodsProbeRetry is how long to use the deprecated methods after conduit.query fails
+const methodsProbeRetry = time.Minute * 5
+
+// Modern Conduit methods, used instead of their deprecated equivalents when the install has them
+const (
+	methodRevisionEdit   = "differential.revision.edit"
+	methodDiffSearch     = "differential.diff.search"
+	methodRevisionSearch = "differential.revision.search"
+)
+
+// permanentConduitErrors are error codes that retrying the same call will not fix.  They are all
+// client errors.  ERR-CONDUIT-CORE is left out on purpose: Phabricator answers with it for any
+// unhandled exception, including database deadlocks that go away on retry.
+var permanentConduitErrors = map[string]struct{}{
+	"ERR-INVALID-AUTH":    {},
+	"ERR-INVALID-SESSION": {},
+	"ERR-CONDUIT-CALL":    {},
+}
+
+// conduitError is a failed Conduit call.  Either Conduit answered with an error code, or the web
+// server answered with a status other than 200.
+type conduitError struct {
+	method     string
+	code       string
+	info       string
+	statusCode int
+}
+
+func (e *conduitError) Error() string {
+	if e.code == "" {
+		return fmt.Sprintf("%s: invalid status code %d", e.method, e.statusCode)
+	}
+	return fmt.Sprintf("%s failed with %s: %s", e.method, e.code, e.info)
+}
+
+// permanent is whether the call would fail again if retried.  Server errors and rate limiting
+// are worth retrying.  Other HTTP errors and the error codes in permanentConduitErrors are not.
+func (e *conduitError) permanent() bool {
+	if e.code == "" {
+		return e.statusCode < http.StatusInternalServerError && e.statusCode != http.StatusTooManyRequests
+	}
+	_, exists := permanentConduitErrors[e.code]
+	return exists
+}
+
+// conduitResponse is the envelope every Conduit method responds with
+type conduitResponse struct {
+	Result    json.RawMessage `json:"result"`
+	ErrorCode *string         `json:"error_code"`
+	ErrorInfo *string         `json:"error_info"`
+}
+
+// call POSTs a Conduit method and decodes its result into into, which may be nil.  Failures
+// Conduit reports in the response envelope are returned as a *conduitError.
+func (p *phabricatorConduit) call(ctx context.Context, method string, v url.Values, into interface{}) error {
+	u := *p.url
+	u.Path = "/api/" + method
+	v.Set("api.token", p.apiToken)
+	start := time.Now()
+	resp, err := p.client.PostForm(u.String(), v)
+	metrics.conduitLatency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	metrics.conduitCalls.WithLabelValues(method, statusCode(resp)).Inc()
+	if err != nil {
+		return wraperr(err, "cannot POST %s", method)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &conduitError{method: method, statusCode: resp.StatusCode}
+	}
+	var r conduitResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return wraperr(err, "cannot decode %s response body", method)
+	}
+	if r.ErrorCode != nil {
+		e := &conduitError{method: method, code: *r.ErrorCode}
+		if r.ErrorInfo != nil {
+			e.info = *r.ErrorInfo
+		}
+		return e
+	}
+	if into == nil {
+		return nil
+	}
+	if err := json.Unmarshal(r.Result, into); err != nil {
+		return wraperr(err, "cannot decode %s result", method)
+	}
+	return nil
+}
+
+// supports is whether the install has a Conduit method.  Until conduit.query answers, the
+// deprecated methods are used.
+func (p *phabricatorConduit) supports(ctx context.Context, method string) bool {
+	methods, probe := p.knownMethods()
+	if probe {
+		methods = p.probeMethods(ctx)
+	}
+	_, exists := methods[method]
+	return exists
+}
+
+// knownMethods returns the methods found by the last probe, or whether the caller should probe.
+// Only one caller at a time is told to probe.
+func (p *phabricatorConduit) knownMethods() (map[string]struct{}, bool) {
+	p.methodsMu.Lock()
+	defer p.methodsMu.Unlock()
+	if p.methods != nil || time.Now().Before(p.methodsRetry) {
+		return p.methods, false
+	}
+	p.methodsRetry = time.Now().Add(methodsProbeRetry)
+	return nil, true
+}
+
+// probeMethods asks conduit.query for the methods, without holding methodsMu so other calls are
+// not held up by a slow Phabricator
+func (p *phabricatorConduit) probeMethods(ctx context.Context) map[string]struct{} {
+	methods := make(map[string]json.RawMessage)
+	if err := p.call(ctx, "conduit.query", url.Values{}, &methods); err != nil {
+		logIfErr(getLog(ctx), err, "cannot list conduit methods, using deprecated ones for %s", methodsProbeRetry)
+		return nil
+	}
+	ret := make(map[string]struct{}, len(methods))
+	for name := range methods {
+		ret[name] = struct{}{}
+	}
+	p.methodsMu.Lock()
+	defer p.methodsMu.Unlock()
+	p.methods = ret
+	return ret
 }
 
 type queryResult struct {
@@ -56,9 +194,19 @@ type harbormasterUnitResult struct {
 	Engine    string     `json:"engine,omitempty"`
 	Duration  *float64   `json:"duration,omitempty"`
 	Path      string     `json:"path,omitempty"`
+	Details   string     `json:"details,omitempty"`
+	// Coverage maps each file to one character per line, as in differential's NCUX format
+	Coverage map[string]string `json:"coverage,omitempty"`
 }
 
 type lintResult struct {
+	Name        string `json:"name"`
+	Code        string `json:"code"`
+	Severity    string `json:"severity"`
+	Path        string `json:"path"`
+	Line        int    `json:"line,omitempty"`
+	Char        int    `json:"char,omitempty"`
+	Description string `json:"description,omitempty"`
 }
 
 type harbormasterType string
@@ -66,15 +214,11 @@ type harbormasterType string
 const (
 	harbormasterPass = harbormasterType("pass")
 	harbormasterFail = harbormasterType("fail")
-
-//	HarbormasterWork = harbormasterType("work")
+	harbormasterWork = harbormasterType("work")
 )
 
 func (p *phabricatorConduit) updateHarbormaster(ctx context.Context, phid string, t harbormasterType, units []harbormasterUnitResult, lints []lintResult) error {
-	u := *p.url
-	u.Path = "/api/harbormaster.sendmessage"
 	v := url.Values{}
-	v.Add("api.token", p.apiToken)
 	v.Add("buildTargetPHID", phid)
 	v.Add("type", string(t))
 	if len(units) > 0 {
@@ -82,82 +226,119 @@ func (p *phabricatorConduit) updateHarbormaster(ctx context.Context, phid string
 		if err != nil {
 			return wraperr(err, "cannot marshall unit tests")
 		}
-		v.Add("unit", string(unitStr))
+		v.Add("unit", p.secrets.redact(string(unitStr)))
 	}
 	if len(lints) > 0 {
 		lintStr, err := json.Marshal(&lints)
 		if err != nil {
 			return wraperr(err, "cannot marshall lints tests")
 		}
-		v.Add("lint", string(lintStr))
-	}
-	resp, err := p.client.PostForm(u.String(), v)
-	if err != nil {
-		return wraperr(err, "cannot POST comment")
+		v.Add("lint", p.secrets.redact(string(lintStr)))
 	}
-	getLog(ctx).Printf("Posted to URI %s", u.String())
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("invalid status code %d", resp.StatusCode)
+	if err := p.call(ctx, "harbormaster.sendmessage", v, nil); err != nil {
+		return err
 	}
+	getLog(ctx).Printf("Sent %s to build target %s", t, phid)
+	return nil
+}
 
+// createURIArtifact attaches a link, shown on the build target, to a Harbormaster build target
+func (p *phabricatorConduit) createURIArtifact(ctx context.Context, phid string, key string, name string, uri string) error {
+	v := url.Values{}
+	v.Add("buildTargetPHID", phid)
+	v.Add("artifactKey", key)
+	v.Add("artifactType", "uri")
+	v.Add("artifactData[uri]", uri)
+	v.Add("artifactData[name]", name)
+	v.Add("artifactData[ui]", "1")
+	if err := p.call(ctx, "harbormaster.createartifact", v, nil); err != nil {
+		return err
+	}
+	getLog(ctx).Printf("Created artifact %s on %s", key, phid)
 	return nil
 }
 
+// createComment comments on a revision, with differential.revision.edit if the install has it
 func (p *phabricatorConduit) createComment(ctx context.Context, revisionID int, message string) error {
-	u := *p.url
-	u.Path = "/api/differential.createcomment"
-	v := url.Values{}
-	v.Add("api.token", p.apiToken)
-	revisionIStr := strconv.FormatInt(int64(revisionID), 10)
-	v.Add("revision_id", revisionIStr)
-	v.Add("message", message)
-	resp, err := p.client.PostForm(u.String(), v)
-	if err != nil {
-		return wraperr(err, "cannot POST comment")
+	message = p.secrets.redact(message)
+	if !p.supports(ctx, methodRevisionEdit) {
+		return p.createCommentLegacy(ctx, revisionID, message)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("invalid status code %d", resp.StatusCode)
+	v := url.Values{}
+	v.Add("objectIdentifier", strconv.FormatInt(int64(revisionID), 10))
+	v.Add("transactions[0][type]", "comment")
+	v.Add("transactions[0][value]", message)
+	if err := p.call(ctx, methodRevisionEdit, v, nil); err != nil {
+		return err
 	}
+	getLog(ctx).Printf("Commented on revision %d", revisionID)
+	return nil
+}
+
+func (p *phabricatorConduit) createCommentLegacy(ctx context.Context, revisionID int, message string) error {
+	v := url.Values{}
+	v.Add("revision_id", strconv.FormatInt(int64(revisionID), 10))
+	v.Add("message", message)
 	queryRes := createCommentResult{}
-	d := json.NewDecoder(resp.Body)
-	if err := d.Decode(&queryRes); err != nil {
-		return wraperr(err, "cannot decode response body")
+	if err := p.call(ctx, "differential.createcomment", v, &queryRes); err != nil {
+		return err
 	}
 	getLog(ctx).Printf("Posted to URI %s", queryRes.URI)
 	return nil
 }
 
+// searchResult is the result of the *.search Conduit methods
+type searchResult struct {
+	Data []struct {
+		ID     int    `json:"id"`
+		PHID   string `json:"phid"`
+		Fields struct {
+			RevisionPHID string `json:"revisionPHID"`
+		} `json:"fields"`
+	} `json:"data"`
+}
+
+// revisionForDiff finds the revision a diff belongs to, or zero if it belongs to none
 func (p *phabricatorConduit) revisionForDiff(ctx context.Context, diffid int) (int, error) {
-	u := *p.url
-	u.Path = "/api/differential.querydiffs"
+	if !p.supports(ctx, methodDiffSearch) || !p.supports(ctx, methodRevisionSearch) {
+		return p.revisionForDiffLegacy(ctx, diffid)
+	}
 	v := url.Values{}
-	v.Add("api.token", p.apiToken)
-	idStr := strconv.FormatInt(int64(diffid), 10)
-	v.Add("ids[0]", idStr)
-	resp, err := p.client.PostForm(u.String(), v)
-	if err != nil {
+	v.Add("constraints[ids][0]", strconv.FormatInt(int64(diffid), 10))
+	var diffs searchResult
+	if err := p.call(ctx, methodDiffSearch, v, &diffs); err != nil {
 		return 0, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("invalid status code %d", resp.StatusCode)
+	if len(diffs.Data) == 0 {
+		return 0, fmt.Errorf("cannot find diff %d", diffid)
 	}
-	queryRes := queryResult{}
-	bodyBuff := bytes.Buffer{}
-	_, err = io.Copy(&bodyBuff, resp.Body)
-	getLog(ctx).Printf("response len is %d", bodyBuff.Len())
-	if err != nil {
-		return 0, wraperr(err, "cannot read from response body")
+	revisionPHID := diffs.Data[0].Fields.RevisionPHID
+	if revisionPHID == "" {
+		return 0, nil
 	}
-	d := json.NewDecoder(&bodyBuff)
-	if err := d.Decode(&queryRes); err != nil {
-		return 0, wraperr(err, "cannot decode response body")
+	v = url.Values{}
+	v.Add("constraints[phids][0]", revisionPHID)
+	var revisions searchResult
+	if err := p.call(ctx, methodRevisionSearch, v, &revisions); err != nil {
+		return 0, err
+	}
+	if len(revisions.Data) == 0 {
+		return 0, fmt.Errorf("cannot find revision %s of diff %d", revisionPHID, diffid)
+	}
+	return revisions.Data[0].ID, nil
+}
+
+func (p *phabricatorConduit) revisionForDiffLegacy(ctx context.Context, diffid int) (int, error) {
+	v := url.Values{}
+	idStr := strconv.FormatInt(int64(diffid), 10)
+	v.Add("ids[0]", idStr)
+	queryRes := queryResult{}
+	if err := p.call(ctx, "differential.querydiffs", v, &queryRes.Result); err != nil {
+		return 0, err
 	}
 	obj, exists := queryRes.Result[idStr]
 	if !exists || obj == nil {
-		return 0, fmt.Errorf("cannot find diff for %d in queryRes %v obj %s", diffid, queryRes, obj.String())
+		return 0, fmt.Errorf("cannot find diff for %d in queryRes %v", diffid, queryRes)
 	}
 	if obj.RevisionID == "" {
 		return 0, nil
@@ -168,3 +349,8 @@ func (p *phabricatorConduit) revisionForDiff(ctx context.Context, diffid int) (i
 	}
 	return int(parsedRev), nil
 }
+
+// ping checks Phabricator is up and accepts the API token
+func (p *phabricatorConduit) ping(ctx context.Context) error {
+	return p.call(ctx, "conduit.ping", url.Values{}, nil)
+}
@@ -2,8 +2,17 @@ package main
 
 import (
 	"encoding/json"
-	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
 var phabResp1 = `{
@@ -89,3 +98,136 @@ func TestDecode(t *testing.T) {
 	})
 
 }
+
+// newTestConduit returns a conduit pointed at a server that records the form of every call
+func newTestConduit(t *testing.T, response string) (*phabricatorConduit, *httptest.Server, map[string]url.Values) {
+	return newRoutedConduit(t, map[string]string{"": response})
+}
+
+// newRoutedConduit is newTestConduit with a response per API path.  The "" path answers the rest.
+func newRoutedConduit(t *testing.T, responses map[string]string) (*phabricatorConduit, *httptest.Server, map[string]url.Values) {
+	calls := make(map[string]url.Values)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Nil(t, req.ParseForm())
+		calls[req.URL.Path] = req.PostForm
+		response, exists := responses[req.URL.Path]
+		if !exists {
+			response = responses[""]
+		}
+		rw.Write([]byte(response))
+	}))
+	u, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+	return &phabricatorConduit{
+		apiToken: "api-token",
+		url:      u,
+	}, server, calls
+}
+
+func TestCreateURIArtifact(t *testing.T) {
+	p, server, calls := newTestConduit(t, `{"result": {}, "error_code": null, "error_info": null}`)
+	defer server.Close()
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	assert.Nil(t, p.createURIArtifact(ctx, "PHID-HMBT-1", "circleci.build", "CircleCI build", "https://circleci.com/gh/a/b/1"))
+	form := calls["/api/harbormaster.createartifact"]
+	assert.Equal(t, "PHID-HMBT-1", form.Get("buildTargetPHID"))
+	assert.Equal(t, "uri", form.Get("artifactType"))
+	assert.Equal(t, "https://circleci.com/gh/a/b/1", form.Get("artifactData[uri]"))
+	assert.Equal(t, "api-token", form.Get("api.token"))
+}
+
+func TestModernConduitMethods(t *testing.T) {
+	p, server, calls := newRoutedConduit(t, map[string]string{
+		"/api/conduit.query":                `{"result": {"differential.revision.edit": {}, "differential.diff.search": {}, "differential.revision.search": {}}, "error_code": null, "error_info": null}`,
+		"/api/differential.revision.edit":   `{"result": {"object": {"id": 6848}}, "error_code": null, "error_info": null}`,
+		"/api/differential.diff.search":     `{"result": {"data": [{"id": 12961, "fields": {"revisionPHID": "PHID-DREV-1"}}]}, "error_code": null, "error_info": null}`,
+		"/api/differential.revision.search": `{"result": {"data": [{"id": 6848, "phid": "PHID-DREV-1"}]}, "error_code": null, "error_info": null}`,
+	})
+	defer server.Close()
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+
+	assert.Nil(t, p.createComment(ctx, 6848, "hello"))
+	form := calls["/api/differential.revision.edit"]
+	assert.Equal(t, "6848", form.Get("objectIdentifier"))
+	assert.Equal(t, "comment", form.Get("transactions[0][type]"))
+	assert.Equal(t, "hello", form.Get("transactions[0][value]"))
+	_, legacy := calls["/api/differential.createcomment"]
+	assert.False(t, legacy)
+
+	rev, err := p.revisionForDiff(ctx, 12961)
+	assert.Nil(t, err)
+	assert.Equal(t, 6848, rev)
+	assert.Equal(t, "12961", calls["/api/differential.diff.search"].Get("constraints[ids][0]"))
+	assert.Equal(t, "PHID-DREV-1", calls["/api/differential.revision.search"].Get("constraints[phids][0]"))
+}
+
+func TestLegacyConduitMethods(t *testing.T) {
+	p, server, calls := newRoutedConduit(t, map[string]string{
+		"/api/conduit.query":              `{"result": null, "error_code": "ERR-CONDUIT-CORE", "error_info": "nope"}`,
+		"/api/differential.createcomment": `{"result": {"revision_id": "6848", "uri": "http://phab/D6848"}, "error_code": null, "error_info": null}`,
+		"/api/differential.querydiffs":    phabResp1,
+	})
+	defer server.Close()
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+
+	assert.Nil(t, p.createComment(ctx, 6848, "hello"))
+	assert.Equal(t, "hello", calls["/api/differential.createcomment"].Get("message"))
+
+	rev, err := p.revisionForDiff(ctx, 12961)
+	assert.Nil(t, err)
+	assert.Equal(t, 6848, rev)
+}
+
+func TestConduitProbeRetry(t *testing.T) {
+	probes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		probes++
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+	p := &phabricatorConduit{url: u}
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+
+	assert.False(t, p.supports(ctx, methodRevisionEdit))
+	assert.False(t, p.supports(ctx, methodDiffSearch))
+	assert.Equal(t, 1, probes)
+
+	// Once the retry time passes, the next call probes again
+	p.methodsRetry = time.Time{}
+	assert.False(t, p.supports(ctx, methodRevisionEdit))
+	assert.Equal(t, 2, probes)
+}
+
+func TestConduitErrorEnvelope(t *testing.T) {
+	p, server, _ := newTestConduit(t, `{"result": null, "error_code": "ERR-CONDUIT-CORE", "error_info": "Build target does not exist"}`)
+	defer server.Close()
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+
+	err := p.updateHarbormaster(ctx, "PHID-HMBT-1", harbormasterPass, nil, nil)
+	cerr, ok := err.(*conduitError)
+	assert.True(t, ok)
+	assert.Equal(t, "ERR-CONDUIT-CORE", cerr.code)
+	assert.Equal(t, "Build target does not exist", cerr.info)
+	assert.Contains(t, err.Error(), "harbormaster.sendmessage")
+	// Core errors include transient server failures, so they are retried
+	assert.False(t, isPermanent(err))
+
+	assert.NotNil(t, p.createURIArtifact(ctx, "PHID-HMBT-1", "k", "n", "https://example.com"))
+}
+
+func TestConduitRedactsPostedText(t *testing.T) {
+	p, server, calls := newTestConduit(t, `{"result": {}, "error_code": null, "error_info": null}`)
+	defer server.Close()
+	p.secrets = newRedactor("circle-token")
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+
+	units := []harbormasterUnitResult{{Name: "a", Result: unitFail, Details: "curl -H 'Circle-Token: circle-token' failed"}}
+	lints := []lintResult{{Name: "b", Description: "token circle-token in config"}}
+	assert.Nil(t, p.updateHarbormaster(ctx, "PHID-1", harbormasterFail, units, lints))
+	form := calls["/api/harbormaster.sendmessage"]
+	assert.NotContains(t, form.Get("unit"), "circle-token")
+	assert.Contains(t, form.Get("unit"), redactedText)
+	assert.NotContains(t, form.Get("lint"), "circle-token")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// defaultCoverageArtifacts are the artifact globs read as coverage reports unless a repository overrides them
+var defaultCoverageArtifacts = []string{"**/coverage.out", "**/cobertura*.xml", "**/coverage.xml", "**/lcov.info"}
+
+// lineCoverage is, per file, whether each executable line was covered
+type lineCoverage map[string]map[int]bool
+
+// mark records a line.  A line that any report covered stays covered.
+func (l lineCoverage) mark(file string, line int, covered bool) {
+	if line < 1 {
+		return
+	}
+	lines, exists := l[file]
+	if !exists {
+		lines = make(map[int]bool)
+		l[file] = lines
+	}
+	lines[line] = lines[line] || covered
+}
+
+func (l lineCoverage) merge(other lineCoverage) {
+	for file, lines := range other {
+		for line, covered := range lines {
+			l.mark(file, line, covered)
+		}
+	}
+}
+
+// maxCoverageLines caps the lines reported for a file whose line count is not known
+const maxCoverageLines = 100000
+
+func (l lineCoverage) files() []string {
+	ret := make([]string, 0, len(l))
+	for file := range l {
+		ret = append(ret, file)
+	}
+	return ret
+}
+
+// harbormaster converts coverage into Harbormaster's per file strings, with one character per
+// line: C for covered, U for uncovered and N for lines that are not executable.  Lines past the
+// end of the file, as given by lineCounts or else maxCoverageLines, are dropped.
+func (l lineCoverage) harbormaster(lineCounts map[string]int) map[string]string {
+	ret := make(map[string]string, len(l))
+	for file, lines := range l {
+		limit, known := lineCounts[file]
+		if !known {
+			limit = maxCoverageLines
+		}
+		last := 0
+		for line := range lines {
+			if line > last && line <= limit {
+				last = line
+			}
+		}
+		if last == 0 {
+			continue
+		}
+		buf := bytes.Repeat([]byte("N"), last)
+		for line, covered := range lines {
+			if line > last {
+				continue
+			}
+			buf[line-1] = 'U'
+			if covered {
+				buf[line-1] = 'C'
+			}
+		}
+		ret[file] = string(buf)
+	}
+	return ret
+}
+
+// parseGoCover reads a Go cover profile, as written by go test -coverprofile
+func parseGoCover(body []byte, pathPrefix string) (lineCoverage, error) {
+	ret := make(lineCoverage)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "mode:") {
+			continue
+		}
+		// name.go:line.column,line.column numberOfStatements count
+		var file string
+		var startLine, startCol, endLine, endCol, statements, count int
+		colon := strings.LastIndex(line, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("invalid cover profile line %s", line)
+		}
+		file = line[:colon]
+		if _, err := fmt.Sscanf(line[colon+1:], "%d.%d,%d.%d %d %d", &startLine, &startCol, &endLine, &endCol, &statements, &count); err != nil {
+			return nil, wraperr(err, "invalid cover profile line %s", line)
+		}
+		file = strings.TrimPrefix(file, pathPrefix)
+		for i := startLine; i <= endLine; i++ {
+			ret.mark(file, i, count > 0)
+		}
+	}
+	return ret, scanner.Err()
+}
+
+// parseLCOV reads an LCOV tracefile
+func parseLCOV(body []byte, pathPrefix string) (lineCoverage, error) {
+	ret := make(lineCoverage)
+	file := ""
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "SF:"):
+			file = strings.TrimPrefix(strings.TrimPrefix(line, "SF:"), pathPrefix)
+		case strings.HasPrefix(line, "DA:") && file != "":
+			parts := strings.Split(strings.TrimPrefix(line, "DA:"), ",")
+			if len(parts) < 2 {
+				return nil, fmt.Errorf("invalid LCOV line %s", line)
+			}
+			lineNum, err := strconv.Atoi(parts[0])
+			if err != nil {
+				return nil, wraperr(err, "invalid LCOV line %s", line)
+			}
+			hits, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return nil, wraperr(err, "invalid LCOV line %s", line)
+			}
+			ret.mark(file, lineNum, hits > 0)
+		case line == "end_of_record":
+			file = ""
+		}
+	}
+	return ret, scanner.Err()
+}
+
+type coberturaReport struct {
+	Sources []string `xml:"sources>source"`
+	Classes []struct {
+		Filename string `xml:"filename,attr"`
+		Lines    []struct {
+			Number int   `xml:"number,attr"`
+			Hits   int64 `xml:"hits,attr"`
+		} `xml:"lines>line"`
+	} `xml:"packages>package>classes>class"`
+}
+
+// parseCobertura reads a Cobertura XML report
+func parseCobertura(body []byte, pathPrefix string) (lineCoverage, error) {
+	var report coberturaReport
+	if err := xml.Unmarshal(body, &report); err != nil {
+		return nil, wraperr(err, "cannot decode Cobertura XML")
+	}
+	ret := make(lineCoverage)
+	for _, c := range report.Classes {
+		file := c.Filename
+		// Class file names are relative to a source directory, which may itself be the checkout
+		if len(report.Sources) > 0 && !path.IsAbs(file) {
+			file = path.Join(report.Sources[0], file)
+		}
+		file = strings.TrimPrefix(file, pathPrefix)
+		for _, l := range c.Lines {
+			ret.mark(file, l.Number, l.Hits > 0)
+		}
+	}
+	return ret, nil
+}
+
+// parseCoverage detects the format of a coverage report from its contents
+func parseCoverage(body []byte, pathPrefix string) (lineCoverage, error) {
+	trimmed := bytes.TrimSpace(body)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("mode:")):
+		return parseGoCover(trimmed, pathPrefix)
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return parseCobertura(trimmed, pathPrefix)
+	case bytes.HasPrefix(trimmed, []byte("TN:")) || bytes.HasPrefix(trimmed, []byte("SF:")):
+		return parseLCOV(trimmed, pathPrefix)
+	}
+	return nil, fmt.Errorf("unknown coverage report format")
+}
+
+// coverage reads every coverage report artifact of the build into Harbormaster's format
+func (g *circleCiMsg) coverage(ctx context.Context, ci ciProvider, artifacts []ciArtifact) (map[string]string, error) {
+	cfg := g.repoConfig()
+	ret := make(lineCoverage)
+	err := fetchMatchingArtifacts(ctx, ci, artifacts, cfg.CoverageArtifacts, func(a ciArtifact, body []byte) error {
+		c, err := parseCoverage(body, cfg.ArtifactPathPrefix)
+		if err != nil {
+			logIfErr(getLog(ctx), err, "cannot parse coverage report %s", a.Path)
+			return nil
+		}
+		ret.merge(c)
+		return nil
+	})
+	if err != nil || len(ret) == 0 {
+		return nil, err
+	}
+	params := g.FormParams.Payload.BuildParameters
+	lineCounts, err := g.parent.git.lineCounts(ctx, params["staging_uri"], params["staging_ref"], ret.files())
+	logIfErr(getLog(ctx), err, "cannot count lines of covered files")
+	return ret.harbormaster(lineCounts), nil
+}
+
+// attachCoverage adds coverage to the unit results.  Harbormaster merges the coverage of every
+// unit result, so it goes on the first one, or on a placeholder when there were no tests.
+func attachCoverage(units []harbormasterUnitResult, coverage map[string]string) []harbormasterUnitResult {
+	if len(coverage) == 0 {
+		return units
+	}
+	if len(units) == 0 {
+		units = append(units, harbormasterUnitResult{
+			Name:   "Coverage",
+			Result: unitPass,
+		})
+	}
+	units[0].Coverage = coverage
+	return units
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGoCover(t *testing.T) {
+	profile := `mode: set
+github.com/signalfx/abc/main.go:3.13,5.2 1 1
+github.com/signalfx/abc/main.go:7.2,7.10 1 0
+github.com/signalfx/abc/util.go:2.1,2.5 1 0
+`
+	c, err := parseCoverage([]byte(profile), "github.com/signalfx/abc/")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"main.go": "NNCCCNU",
+		"util.go": "NU",
+	}, c.harbormaster(nil))
+
+	_, err = parseCoverage([]byte("mode: set\nmain.go:bad"), "")
+	assert.NotNil(t, err)
+}
+
+func TestParseLCOV(t *testing.T) {
+	tracefile := `TN:
+SF:/src/app/a.js
+DA:1,4
+DA:3,0
+end_of_record
+SF:/src/app/b.js
+DA:2,1
+end_of_record
+`
+	c, err := parseCoverage([]byte(tracefile), "/src/app/")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"a.js": "CNU",
+		"b.js": "NC",
+	}, c.harbormaster(nil))
+}
+
+func TestParseCobertura(t *testing.T) {
+	report := `<?xml version="1.0" ?>
+<coverage line-rate="0.5">
+  <sources><source>/home/circleci/project</source></sources>
+  <packages><package name="pkg"><classes>
+    <class name="a" filename="pkg/a.py"><lines>
+      <line number="1" hits="2"/>
+      <line number="2" hits="0"/>
+    </lines></class>
+  </classes></package></packages>
+</coverage>`
+	c, err := parseCoverage([]byte(report), "/home/circleci/project/")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"pkg/a.py": "CU"}, c.harbormaster(nil))
+
+	_, err = parseCoverage([]byte("no idea"), "")
+	assert.NotNil(t, err)
+}
+
+func TestCoverageMerge(t *testing.T) {
+	c := make(lineCoverage)
+	c.mark("a.go", 1, false)
+	other := make(lineCoverage)
+	other.mark("a.go", 1, true)
+	other.mark("a.go", 2, false)
+	c.merge(other)
+	assert.Equal(t, map[string]string{"a.go": "CU"}, c.harbormaster(nil))
+}
+
+func TestCoverageLineLimit(t *testing.T) {
+	c := make(lineCoverage)
+	c.mark("a.go", 1, true)
+	c.mark("a.go", 3, false)
+	c.mark("a.go", 1<<40, true)
+	c.mark("gone.go", 5, true)
+	assert.Equal(t, map[string]string{"a.go": "CNU"}, c.harbormaster(map[string]int{"a.go": 3, "gone.go": 2}))
+	assert.Equal(t, map[string]string{"a.go": "CNU", "gone.go": "NNNNC"}, c.harbormaster(nil))
+}
+
+func TestAttachCoverage(t *testing.T) {
+	assert.Nil(t, attachCoverage(nil, nil))
+
+	units := attachCoverage(nil, map[string]string{"a.go": "C"})
+	assert.Equal(t, 1, len(units))
+	assert.Equal(t, unitPass, units[0].Result)
+	assert.Equal(t, "C", units[0].Coverage["a.go"])
+
+	units = attachCoverage([]harbormasterUnitResult{{Name: "t1"}, {Name: "t2"}}, map[string]string{"a.go": "U"})
+	assert.Equal(t, "U", units[0].Coverage["a.go"])
+	assert.Nil(t, units[1].Coverage)
+}
@@ -1,43 +1,76 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"golang.org/x/net/context"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// repoLocks hands out one mutex per clone directory, so unrelated repositories do not wait on
+// each other
+type repoLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock blocks until repoDir is free and returns the function that frees it
+func (r *repoLocks) lock(repoDir string) func() {
+	r.mu.Lock()
+	if r.locks == nil {
+		r.locks = make(map[string]*sync.Mutex)
+	}
+	l, exists := r.locks[repoDir]
+	if !exists {
+		l = &sync.Mutex{}
+		r.locks[repoDir] = l
+	}
+	r.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
 type githubPusher struct {
-	lock   sync.Mutex
+	locks  repoLocks
 	tmpDir string
 	phab   *phabricatorConduit
-	cc     *circleClient
 }
 
 func (p *githubPusher) setupRepository(ctx context.Context, url string) error {
-	p.lock.Lock()
-	defer p.lock.Unlock()
 	repoDir, err := cloneDir(url)
 	if err != nil {
 		return wraperr(err, "cannot find directory to clone into")
 	}
+	defer p.locks.lock(repoDir)()
 	l := getLog(ctx)
 	ultimateDir := filepath.Join(p.tmpDir, repoDir)
 	if _, err := os.Stat(ultimateDir); err == nil {
 		// Already exists
 		return nil
 	}
-	cloneCmd := exec.Command("git", "clone", url)
+	// Clone to the side and rename, so a clone that dies halfway never looks like a usable repository
+	cloningDir := filepath.Join(p.tmpDir, "."+repoDir+".cloning")
+	if err := os.RemoveAll(cloningDir); err != nil {
+		return wraperr(err, "cannot remove stale clone %s", cloningDir)
+	}
+	cloneCmd := exec.Command("git", "clone", url, cloningDir)
 	cloneCmd.Dir = p.tmpDir
 	l.Printf("Running command %#v", cloneCmd)
-	cmdBytes, err := cloneCmd.CombinedOutput()
+	cmdBytes, err := runGit(cloneCmd)
 	if err != nil {
 		return wraperr(err, "cannot clone repository %s: %s", url, string(cmdBytes))
 	}
+	if err := os.Rename(cloningDir, ultimateDir); err != nil {
+		return wraperr(err, "cannot move clone into %s", ultimateDir)
+	}
 	_, err = os.Stat(ultimateDir)
 	return err
 }
@@ -67,8 +100,7 @@ func circleProject(uri string) (string, error) {
 }
 
 func (p *githubPusher) updateRepository(ctx context.Context, repoName string) error {
-	p.lock.Lock()
-	defer p.lock.Unlock()
+	defer p.locks.lock(repoName)()
 	l := getLog(ctx)
 	ultimateDir := filepath.Join(p.tmpDir, repoName)
 	if _, err := os.Stat(ultimateDir); err != nil {
@@ -77,7 +109,7 @@ func (p *githubPusher) updateRepository(ctx context.Context, repoName string) er
 	cloneCmd := exec.Command("git", "fetch", "--all", "-a", "-v", "--tags")
 	cloneCmd.Dir = ultimateDir
 	l.Printf("Running command %#v", cloneCmd)
-	cmdBytes, err := cloneCmd.CombinedOutput()
+	cmdBytes, err := runGit(cloneCmd)
 	if err != nil {
 		return wraperr(err, "cannot update repository %s: %s", repoName, string(cmdBytes))
 	}
@@ -86,8 +118,7 @@ func (p *githubPusher) updateRepository(ctx context.Context, repoName string) er
 }
 
 func (p *githubPusher) pushOrigin(ctx context.Context, repoName string, pushString string) error {
-	p.lock.Lock()
-	defer p.lock.Unlock()
+	defer p.locks.lock(repoName)()
 	l := getLog(ctx)
 	ultimateDir := filepath.Join(p.tmpDir, repoName)
 	if _, err := os.Stat(ultimateDir); err != nil {
@@ -96,7 +127,7 @@ func (p *githubPusher) pushOrigin(ctx context.Context, repoName string, pushStri
 	pushCmd := exec.Command("git", "push", "--force", "origin", pushString)
 	pushCmd.Dir = ultimateDir
 	l.Printf("Running command %#v", pushCmd)
-	cmdBytes, err := pushCmd.CombinedOutput()
+	cmdBytes, err := runGit(pushCmd)
 	if err != nil {
 		return wraperr(err, "cannot update repository %s: %s", repoName, string(cmdBytes))
 	}
@@ -104,8 +135,7 @@ func (p *githubPusher) pushOrigin(ctx context.Context, repoName string, pushStri
 }
 
 func (p *githubPusher) removeTag(ctx context.Context, repoName string, tag string) error {
-	p.lock.Lock()
-	defer p.lock.Unlock()
+	defer p.locks.lock(repoName)()
 	l := getLog(ctx)
 	ultimateDir := filepath.Join(p.tmpDir, repoName)
 	if _, err := os.Stat(ultimateDir); err != nil {
@@ -114,11 +144,110 @@ func (p *githubPusher) removeTag(ctx context.Context, repoName string, tag strin
 	pushCmd := exec.Command("git", "push", "origin", ":"+tag)
 	pushCmd.Dir = ultimateDir
 	l.Printf("Running command %#v", pushCmd)
-	cmdBytes, err := pushCmd.CombinedOutput()
+	cmdBytes, err := runGit(pushCmd)
 	if err != nil {
 		return wraperr(err, "cannot update repository %s: %s", repoName, string(cmdBytes))
 	}
 	return nil
 }
 
+// lineCounts counts the lines of files as of ref in the clone of uri, with a single git cat-file.
+// Files the clone does not have at ref are left out.
+func (p *githubPusher) lineCounts(ctx context.Context, uri string, ref string, files []string) (map[string]int, error) {
+	repoName, err := cloneDir(uri)
+	if err != nil {
+		return nil, wraperr(err, "cannot find clone directory")
+	}
+	defer p.locks.lock(repoName)()
+	ultimateDir := filepath.Join(p.tmpDir, repoName)
+	if _, err := os.Stat(ultimateDir); err != nil {
+		return nil, wraperr(err, "cannot stat directory %s", ultimateDir)
+	}
+	var asked []string
+	input := &bytes.Buffer{}
+	for _, f := range files {
+		// Each object name is one line of input
+		if strings.ContainsAny(f, "\n\r") {
+			continue
+		}
+		asked = append(asked, f)
+		fmt.Fprintf(input, "%s:%s\n", ref, f)
+	}
+	catCmd := exec.Command("git", "cat-file", "--batch")
+	catCmd.Dir = ultimateDir
+	catCmd.Stdin = input
+	// Only stdout is parsed, so nothing git writes to stderr can corrupt the batch
+	stderr := &bytes.Buffer{}
+	catCmd.Stderr = stderr
+	cmdBytes, err := timeGit(catCmd, catCmd.Output)
+	if err != nil {
+		return nil, wraperr(err, "cannot read files of %s: %s", ref, stderr.String())
+	}
+	return parseCatFileBatch(cmdBytes, asked)
+}
+
+// parseCatFileBatch counts the lines of each object in git cat-file --batch output.  files are
+// the paths asked for, in order.
+func parseCatFileBatch(out []byte, files []string) (map[string]int, error) {
+	ret := make(map[string]int, len(files))
+	for _, f := range files {
+		end := bytes.IndexByte(out, '\n')
+		if end < 0 {
+			return nil, fmt.Errorf("truncated git cat-file output at %s", f)
+		}
+		line := string(out[:end])
+		out = out[end+1:]
+		// <sha> <type> <size>, or <name> missing.  The name may contain spaces.
+		if strings.HasSuffix(line, " missing") {
+			continue
+		}
+		header := strings.Fields(line)
+		if len(header) != 3 {
+			return nil, fmt.Errorf("invalid git cat-file header for %s", f)
+		}
+		size, err := strconv.Atoi(header[2])
+		if err != nil || size > len(out) {
+			return nil, fmt.Errorf("invalid git cat-file header for %s", f)
+		}
+		contents := out[:size]
+		lines := bytes.Count(contents, []byte("\n"))
+		if size > 0 && contents[size-1] != '\n' {
+			lines++
+		}
+		ret[f] = lines
+		// The contents are followed by a newline
+		out = bytes.TrimPrefix(out[size:], []byte("\n"))
+	}
+	return ret, nil
+}
+
+// checkWritable makes sure repositories can be cloned into the working directory
+func (p *githubPusher) checkWritable(ctx context.Context) error {
+	f, err := ioutil.TempFile(p.tmpDir, ".writable")
+	if err != nil {
+		return wraperr(err, "cannot write to %s", p.tmpDir)
+	}
+	if err := f.Close(); err != nil {
+		return wraperr(err, "cannot write to %s", p.tmpDir)
+	}
+	return os.Remove(f.Name())
+}
+
+// runGit runs a git command and records how long it took
+func runGit(cmd *exec.Cmd) ([]byte, error) {
+	return timeGit(cmd, cmd.CombinedOutput)
+}
+
+// timeGit records how long run, which runs cmd, takes
+func timeGit(cmd *exec.Cmd, run func() ([]byte, error)) ([]byte, error) {
+	start := time.Now()
+	out, err := run()
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metrics.gitDuration.WithLabelValues(cmd.Args[1], result).Observe(time.Since(start).Seconds())
+	return out, err
+}
+
 var errNotValidMessageType = errors.New("invalid message type")
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepoLocks(t *testing.T) {
+	r := repoLocks{}
+	unlockA := r.lock("a")
+
+	// A different repository is not blocked
+	unlockB := r.lock("b")
+	unlockB()
+
+	acquired := make(chan struct{})
+	go func() {
+		r.lock("a")()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second lock of a should block")
+	case <-time.After(time.Millisecond * 20):
+	}
+	unlockA()
+	<-acquired
+}
+
+func TestCloneDir(t *testing.T) {
+	dir, err := cloneDir("git@github.com:signalfx/arepo.git")
+	assert.Nil(t, err)
+	assert.Equal(t, "arepo", dir)
+	_, err = cloneDir("nothing")
+	assert.NotNil(t, err)
+
+	project, err := circleProject("git@github.com:signalfx/arepo.git")
+	assert.Nil(t, err)
+	assert.Equal(t, "signalfx/arepo", project)
+}
+
+func TestParseCatFileBatch(t *testing.T) {
+	out := "abc blob 4\na\nb\n\nmissing.go missing\ndef blob 3\na\nb\n"
+	counts, err := parseCatFileBatch([]byte(out), []string{"a.go", "missing.go", "b.go"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"a.go": 2, "b.go": 2}, counts)
+
+	// git echoes the object name, spaces and all
+	out = "HEAD:docs/read me.md missing\ndef blob 2\na\n\n"
+	counts, err = parseCatFileBatch([]byte(out), []string{"docs/read me.md", "b.go"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"b.go": 1}, counts)
+
+	_, err = parseCatFileBatch([]byte("abc blob 100\nshort\n"), []string{"a.go"})
+	assert.NotNil(t, err)
+}
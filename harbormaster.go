@@ -3,28 +3,36 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/aws/aws-sdk-go/service/sqs"
 	"golang.org/x/net/context"
 	"strconv"
 )
 
+// circleBuildArtifactKey names the build target's link to the CI build
+const circleBuildArtifactKey = "circleci.build"
+
 type harbormasterPublisher struct {
-	gp *githubPusher
+	gp     *githubPusher
+	ci     *ciRegistry
+	builds *buildTracker
 }
 
 type harbormasterMessage struct {
 	AllParamTypes map[string]map[string]string `json:"allParamsJson"`
 
 	gp          *githubPusher
-	originalMsg *sqs.Message
+	ci          *ciRegistry
+	builds      *buildTracker
+	originalMsg *message
 }
 
-func (p *harbormasterPublisher) parseHarbormasterMsg(msg *sqs.Message) (parsedMessage, error) {
+func (p *harbormasterPublisher) parseHarbormasterMsg(msg *message) (parsedMessage, error) {
 	g := harbormasterMessage{
 		originalMsg: msg,
 		gp:          p.gp,
+		ci:          p.ci,
+		builds:      p.builds,
 	}
-	err := json.Unmarshal([]byte(*msg.Body), &g)
+	err := json.Unmarshal([]byte(msg.Body), &g)
 	if err != nil {
 		return nil, err
 	}
@@ -36,10 +44,24 @@ func (p *harbormasterPublisher) parseHarbormasterMsg(msg *sqs.Message) (parsedMe
 
 var _ msgConstructor = (&harbormasterPublisher{}).parseHarbormasterMsg
 
-func (g *harbormasterMessage) OriginalMsg() *sqs.Message {
+func (g *harbormasterMessage) OriginalMsg() *message {
 	return g.originalMsg
 }
 
+func (g *harbormasterMessage) logFields() map[string]interface{} {
+	return map[string]interface{}{
+		"diff":       g.getDiffID(),
+		"revision":   g.getRevID(),
+		"phid":       g.AllParamTypes["querystring"]["phid"],
+		"repository": g.AllParamTypes["querystring"]["callsign"],
+	}
+}
+
+// SerializationKey is the staging repository, since pushes to the same repository must not race
+func (g *harbormasterMessage) SerializationKey() string {
+	return g.AllParamTypes["querystring"]["staging_uri"]
+}
+
 func (g *harbormasterMessage) Execute(ctx context.Context) error {
 	l := getLog(ctx)
 	repoURI := g.AllParamTypes["querystring"]["staging_uri"]
@@ -51,6 +73,11 @@ func (g *harbormasterMessage) Execute(ctx context.Context) error {
 	if err != nil {
 		return wraperr(err, "cannot find circle dir to execute harbormaster msg")
 	}
+	callsign := g.AllParamTypes["querystring"]["callsign"]
+	ci, err := g.ci.forCallsign(callsign)
+	if err != nil {
+		return wraperr(err, "cannot find CI provider to execute harbormaster msg")
+	}
 	if err := g.gp.setupRepository(ctx, repoURI); err != nil {
 		return wraperr(err, "cannot setup repository %s", g.AllParamTypes["querystring"]["staging_uri"])
 	}
@@ -66,12 +93,42 @@ func (g *harbormasterMessage) Execute(ctx context.Context) error {
 		return wraperr(err, "cannot push tag to origin: %s", pushString)
 	}
 
-	resp, err := g.gp.cc.scheduleBuild(ctx, ref, cp,
-		fmt.Sprintf("phabricator_test_%s", g.AllParamTypes["querystring"]["callsign"]),
+	resp, err := ci.scheduleBuild(ctx, ref, cp,
+		fmt.Sprintf("phabricator_test_%s", callsign),
 		g.AllParamTypes["querystring"])
 	if err != nil {
 		return wraperr(err, "cannot post a scheduled bulid for %s", ref)
 	}
+	l = withLogFields(l, map[string]interface{}{"build_num": resp.BuildNum})
+	ctx = setLog(ctx, l)
+	phid := g.AllParamTypes["querystring"]["phid"]
+	config := g.ci.configs.forCallsign(callsign)
+	// Otherwise the watchdog marks the target working once the build leaves CircleCI's queue
+	if !config.workWhenRunning() {
+		logIfErr(l, g.gp.phab.updateHarbormaster(ctx, phid, harbormasterWork, nil, nil), "Unable to mark %s as building", phid)
+	}
+	logIfErr(l, g.gp.phab.createURIArtifact(ctx, phid, circleBuildArtifactKey, "CircleCI build", resp.BuildURL), "Unable to link %s to the build", phid)
+
+	username, project := splitProject(cp)
+	if old, newerDiff := g.builds.start(ctx, trackedBuild{
+		TargetPHID: phid,
+		Diff:       diffID,
+		Revision:   revID,
+		Callsign:   callsign,
+		Username:   username,
+		Project:    project,
+		BuildNum:   resp.BuildNum,
+		BuildURL:   resp.BuildURL,
+		StagingRef: ref,
+		StagingURI: repoURI,
+		Queued:     config.workWhenRunning(),
+	}); old != nil {
+		cancelSuperseded(ctx, g.ci, g.gp.phab, old, newerDiff)
+	}
+
+	if !config.commentOnStart() {
+		return nil
+	}
 	msg := fmt.Sprintf("Your revision is building in CircleCI at %s", resp.BuildURL)
 
 	err = g.gp.phab.createComment(
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// visibilityHeartbeat keeps messages hidden from other receivers while they are processed.  A
+// message that runs past its visibility timeout, for example on a cold git clone, would otherwise be
+// received again and build the same diff twice.
+type visibilityHeartbeat struct {
+	inFlight *inFlightMessages
+	source   messageSource
+	// timeout is the visibility timeout, in seconds, each beat sets
+	timeout int64
+}
+
+// interval beats three times per timeout, so one slow or failed call does not let a message go
+func (h *visibilityHeartbeat) interval() time.Duration {
+	ret := time.Duration(h.timeout) * time.Second / 3
+	if ret < time.Second {
+		return time.Second
+	}
+	return ret
+}
+
+// run extends visibility until ctx ends.  With no visibility timeout there is nothing to extend,
+// and setting zero would make every message visible again.
+func (h *visibilityHeartbeat) run(ctx context.Context) {
+	if h.timeout <= 0 {
+		return
+	}
+	t := time.NewTicker(h.interval())
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			h.inFlight.extend(ctx, h.source, h.timeout)
+		}
+	}
+}
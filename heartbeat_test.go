@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// visibilityRecorder is a memorySource that records every visibility change
+type visibilityRecorder struct {
+	*memorySource
+
+	mu      sync.Mutex
+	changes map[string][]int64
+}
+
+func (v *visibilityRecorder) ChangeVisibility(ctx context.Context, m *message, timeout int64) error {
+	v.mu.Lock()
+	v.changes[m.ID] = append(v.changes[m.ID], timeout)
+	v.mu.Unlock()
+	return v.memorySource.ChangeVisibility(ctx, m, timeout)
+}
+
+func (v *visibilityRecorder) changed(id string) []int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]int64(nil), v.changes[id]...)
+}
+
+func TestHeartbeatInterval(t *testing.T) {
+	assert.Equal(t, time.Second*100, (&visibilityHeartbeat{timeout: 300}).interval())
+	assert.Equal(t, time.Second, (&visibilityHeartbeat{timeout: 1}).interval())
+	assert.Equal(t, time.Second, (&visibilityHeartbeat{}).interval())
+}
+
+func TestExtendOnlyInFlight(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	src := &visibilityRecorder{memorySource: newMemorySource(), changes: map[string][]int64{}}
+	running := src.Send("running")
+	done := src.Send("done")
+	msgs, err := src.Receive(ctx)
+	assert.Nil(t, err)
+
+	f := newInFlightMessages()
+	f.add(msgs...)
+	f.extend(ctx, src, 60)
+	f.remove(done)
+	f.extend(ctx, src, 60)
+	assert.Equal(t, []int64{60, 60}, src.changed(running.ID))
+	assert.Equal(t, []int64{60}, src.changed(done.ID))
+}
+
+func TestRetrierStopsHeartbeat(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	src := &visibilityRecorder{memorySource: newMemorySource(), changes: map[string][]int64{}}
+	f := newInFlightMessages()
+	rt := retrier{
+		source:          src,
+		msgToDeleteChan: make(chan *message, 1),
+		inFlight:        f,
+		log:             getLog(ctx),
+		policy:          retryPolicy{maxAttempts: 5, baseDelay: time.Second * 30, maxDelay: time.Minute},
+	}
+	sent := src.Send("body")
+	msgs, err := src.Receive(ctx)
+	assert.Nil(t, err)
+	f.add(msgs...)
+
+	rt.onFailure(ctx, failedMessage{msg: &failingMsg{msgs[0]}, err: assert.AnError})
+	f.extend(ctx, src, 60)
+	assert.Equal(t, []int64{30}, src.changed(sent.ID))
+	assert.Empty(t, f.list())
+}
+
+func TestHeartbeatRun(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	src := &visibilityRecorder{memorySource: newMemorySource(), changes: map[string][]int64{}}
+	sent := src.Send("body")
+	msgs, err := src.Receive(ctx)
+	assert.Nil(t, err)
+	f := newInFlightMessages()
+	f.add(msgs...)
+
+	h := visibilityHeartbeat{inFlight: f, source: src, timeout: 3}
+	runCtx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		h.run(runCtx)
+		close(stopped)
+	}()
+	for i := 0; i < 300 && len(src.changed(sent.ID)) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	cancel()
+	<-stopped
+	changes := src.changed(sent.ID)
+	if assert.NotEmpty(t, changes) {
+		assert.Equal(t, int64(3), changes[0])
+	}
+}
+
+// stalledSource blocks every visibility change until release is closed
+type stalledSource struct {
+	*memorySource
+	calls   chan *message
+	release chan struct{}
+}
+
+func (s *stalledSource) ChangeVisibility(ctx context.Context, m *message, timeout int64) error {
+	s.calls <- m
+	<-s.release
+	return nil
+}
+
+func TestExtendDoesNotBlockTracking(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	src := &stalledSource{memorySource: newMemorySource(), calls: make(chan *message, 2), release: make(chan struct{})}
+	a := &message{ID: "a"}
+	b := &message{ID: "b"}
+	f := newInFlightMessages()
+	f.add(a, b)
+
+	extended := make(chan struct{})
+	go func() {
+		f.extend(ctx, src, 60)
+		close(extended)
+	}()
+	first := <-src.calls
+	// The source is stuck, but messages can still be added and removed
+	f.add(&message{ID: "c"})
+	second := a
+	if first == a {
+		second = b
+	}
+	f.remove(second)
+	close(src.release)
+	<-extended
+	// The message removed while the first call was stuck is skipped
+	assert.Len(t, src.calls, 0)
+}
+
+func TestHeartbeatWithoutTimeout(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	src := &visibilityRecorder{memorySource: newMemorySource(), changes: map[string][]int64{}}
+	f := newInFlightMessages()
+	f.add(&message{ID: "a"})
+	done := make(chan struct{})
+	go func() {
+		(&visibilityHeartbeat{inFlight: f, source: src}).run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("heartbeat with no visibility timeout kept running")
+	}
+	assert.Empty(t, src.changed("a"))
+}
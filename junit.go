@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// defaultJUnitArtifacts are the artifact globs read as JUnit reports unless a repository overrides them
+var defaultJUnitArtifacts = []string{"**/junit*.xml", "**/TEST-*.xml"}
+
+// junitSuite is either a <testsuites> or a <testsuite> element.  Both may nest suites.
+type junitSuite struct {
+	XMLName xml.Name
+	Name    string       `xml:"name,attr"`
+	Suites  []junitSuite `xml:"testsuite"`
+	Cases   []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Classname string         `xml:"classname,attr"`
+	Name      string         `xml:"name,attr"`
+	Time      string         `xml:"time,attr"`
+	File      string         `xml:"file,attr"`
+	Failures  []junitProblem `xml:"failure"`
+	Errors    []junitProblem `xml:"error"`
+	Skipped   *junitProblem  `xml:"skipped"`
+	SystemOut string         `xml:"system-out"`
+	SystemErr string         `xml:"system-err"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:",chardata"`
+}
+
+func (p junitProblem) String() string {
+	parts := make([]string, 0, 2)
+	for _, s := range []string{p.Message, strings.TrimSpace(p.Body)} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func (c *junitCase) result() (string, []junitProblem) {
+	if len(c.Errors) > 0 {
+		return "error", c.Errors
+	}
+	if len(c.Failures) > 0 {
+		return "failure", c.Failures
+	}
+	if c.Skipped != nil {
+		return "skipped", []junitProblem{*c.Skipped}
+	}
+	return "success", nil
+}
+
+func (c *junitCase) toTestResult(suiteName string) circleTestResult {
+	ret := circleTestResult{
+		Classname: c.Classname,
+		Name:      c.Name,
+		Source:    "junit",
+	}
+	if ret.Classname == "" {
+		ret.Classname = suiteName
+	}
+	// Some reporters write times like 1,234.5
+	ret.RunTime, _ = strconv.ParseFloat(strings.Replace(c.Time, ",", "", -1), 64)
+	if c.File != "" {
+		f := c.File
+		ret.File = &f
+	}
+	var problems []junitProblem
+	ret.Result, problems = c.result()
+	var msg []string
+	for _, p := range problems {
+		if s := p.String(); s != "" {
+			msg = append(msg, s)
+		}
+	}
+	if ret.Result != "success" && ret.Result != "skipped" {
+		for _, s := range []string{c.SystemOut, c.SystemErr} {
+			if s = strings.TrimSpace(s); s != "" {
+				msg = append(msg, s)
+			}
+		}
+	}
+	if len(msg) > 0 {
+		m := strings.Join(msg, "\n")
+		ret.Message = &m
+	}
+	return ret
+}
+
+func (s *junitSuite) testResults() []circleTestResult {
+	var ret []circleTestResult
+	for i := range s.Cases {
+		ret = append(ret, s.Cases[i].toTestResult(s.Name))
+	}
+	for i := range s.Suites {
+		ret = append(ret, s.Suites[i].testResults()...)
+	}
+	return ret
+}
+
+// parseJUnit reads a JUnit or xUnit XML report
+func parseJUnit(body []byte) ([]circleTestResult, error) {
+	var root junitSuite
+	if err := xml.Unmarshal(body, &root); err != nil {
+		return nil, wraperr(err, "cannot decode JUnit XML")
+	}
+	return root.testResults(), nil
+}
+
+// junitTestResults reads test results out of the build's JUnit artifacts, for builds that do not
+// store test metadata with CircleCI
+func (g *circleCiMsg) junitTestResults(ctx context.Context, ci ciProvider, artifacts []ciArtifact) ([]circleTestResult, error) {
+	cfg := g.repoConfig()
+	var ret []circleTestResult
+	err := fetchMatchingArtifacts(ctx, ci, artifacts, cfg.JUnitArtifacts, func(a ciArtifact, body []byte) error {
+		tests, err := parseJUnit(body)
+		if err != nil {
+			logIfErr(getLog(ctx), err, "cannot parse JUnit report %s", a.Path)
+			return nil
+		}
+		ret = append(ret, tests...)
+		return nil
+	})
+	return ret, err
+}
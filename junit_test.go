@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+var exampleJUnit = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="outer">
+    <testcase classname="pkg.A" name="passes" time="1,234.5"></testcase>
+    <testsuite name="inner">
+      <testcase name="fails" time="0.1" file="a_test.go">
+        <failure message="expected 1" type="assert">a_test.go:12</failure>
+        <system-out>some output</system-out>
+      </testcase>
+      <testcase classname="pkg.B" name="errors"><error message="panic"></error></testcase>
+      <testcase classname="pkg.B" name="skips"><skipped/></testcase>
+    </testsuite>
+  </testsuite>
+</testsuites>`
+
+func TestParseJUnit(t *testing.T) {
+	tests, err := parseJUnit([]byte(exampleJUnit))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(tests))
+
+	assert.Equal(t, "success", tests[0].Result)
+	assert.Equal(t, 1234.5, tests[0].RunTime)
+	assert.Nil(t, tests[0].Message)
+
+	assert.Equal(t, "failure", tests[1].Result)
+	assert.Equal(t, "inner", tests[1].Classname)
+	assert.Equal(t, "a_test.go", *tests[1].File)
+	assert.Equal(t, "expected 1\na_test.go:12\nsome output", *tests[1].Message)
+
+	assert.Equal(t, "error", tests[2].Result)
+	assert.Equal(t, "panic", *tests[2].Message)
+	assert.Equal(t, "skipped", tests[3].Result)
+
+	single, err := parseJUnit([]byte(`<testsuite name="s"><testcase name="x"/></testsuite>`))
+	assert.Nil(t, err)
+	assert.Equal(t, "s", single[0].Classname)
+}
+
+func TestJUnitFallback(t *testing.T) {
+	ci := &fakeCI{
+		artifactFiles: map[string]string{
+			"reports/junit.xml": exampleJUnit,
+			"reports/other.xml": "<not-junit/>",
+		},
+	}
+	g := circleCiMsg{
+		parent: &circleManager{},
+	}
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	artifacts, err := ci.artifacts(ctx, "signalfx", "arepo", 1)
+	assert.Nil(t, err)
+	s, units, err := g.populateTestResults(ctx, ci, artifacts)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(units))
+	assert.Equal(t, 2, s.FailingTests)
+	assert.Equal(t, 1, s.PassingTests)
+	assert.Equal(t, 1, s.SkippedTests)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// defaultLintArtifacts are the artifact globs read as lint reports unless a repository overrides them
+var defaultLintArtifacts = []string{"**/checkstyle*.xml", "**/lint*.json"}
+
+type checkstyleReport struct {
+	Files []struct {
+		Name   string `xml:"name,attr"`
+		Errors []struct {
+			Line     int    `xml:"line,attr"`
+			Column   int    `xml:"column,attr"`
+			Severity string `xml:"severity,attr"`
+			Message  string `xml:"message,attr"`
+			Source   string `xml:"source,attr"`
+		} `xml:"error"`
+	} `xml:"file"`
+}
+
+// checkstyleSeverity maps checkstyle severities onto the ones Harbormaster knows
+func checkstyleSeverity(s string) string {
+	switch s {
+	case "error":
+		return "error"
+	case "info", "ignore":
+		return "advice"
+	}
+	return "warning"
+}
+
+func parseCheckstyle(body []byte, pathPrefix string) ([]lintResult, error) {
+	var report checkstyleReport
+	if err := xml.Unmarshal(body, &report); err != nil {
+		return nil, wraperr(err, "cannot decode checkstyle XML")
+	}
+	var ret []lintResult
+	for _, f := range report.Files {
+		for _, e := range f.Errors {
+			code := e.Source
+			if idx := strings.LastIndex(code, "."); idx >= 0 {
+				code = code[idx+1:]
+			}
+			name := e.Source
+			if name == "" {
+				name = "checkstyle"
+			}
+			ret = append(ret, lintResult{
+				Name:        name,
+				Code:        code,
+				Severity:    checkstyleSeverity(e.Severity),
+				Path:        strings.TrimPrefix(f.Name, pathPrefix),
+				Line:        e.Line,
+				Char:        e.Column,
+				Description: e.Message,
+			})
+		}
+	}
+	return ret, nil
+}
+
+// parseJSONLint reads a JSON list of lint messages already in Harbormaster's format
+func parseJSONLint(body []byte, pathPrefix string) ([]lintResult, error) {
+	var ret []lintResult
+	if err := json.Unmarshal(body, &ret); err != nil {
+		return nil, wraperr(err, "cannot decode JSON lint report")
+	}
+	for i := range ret {
+		ret[i].Path = strings.TrimPrefix(ret[i].Path, pathPrefix)
+	}
+	return ret, nil
+}
+
+func parseLintReport(artifactPath string, body []byte, pathPrefix string) ([]lintResult, error) {
+	if strings.HasSuffix(artifactPath, ".json") {
+		return parseJSONLint(body, pathPrefix)
+	}
+	return parseCheckstyle(body, pathPrefix)
+}
+
+// lintResults reads every lint report artifact of the build
+func (g *circleCiMsg) lintResults(ctx context.Context, ci ciProvider, artifacts []ciArtifact) ([]lintResult, error) {
+	cfg := g.repoConfig()
+	var ret []lintResult
+	err := fetchMatchingArtifacts(ctx, ci, artifacts, cfg.LintArtifacts, func(a ciArtifact, body []byte) error {
+		lints, err := parseLintReport(a.Path, body, cfg.ArtifactPathPrefix)
+		if err != nil {
+			logIfErr(getLog(ctx), err, "cannot parse lint report %s", a.Path)
+			return nil
+		}
+		ret = append(ret, lints...)
+		return nil
+	})
+	return ret, err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var exampleCheckstyle = `<?xml version="1.0" encoding="UTF-8"?>
+<checkstyle version="5.0">
+  <file name="/home/circleci/project/main.go">
+    <error line="12" column="3" severity="warning" message="exported func should have comment" source="golint.comment"></error>
+    <error line="20" severity="error" message="unreachable code" source="vet"></error>
+  </file>
+  <file name="/home/circleci/project/empty.go"></file>
+</checkstyle>`
+
+func TestParseCheckstyle(t *testing.T) {
+	lints, err := parseLintReport("reports/checkstyle.xml", []byte(exampleCheckstyle), "/home/circleci/project/")
+	assert.Nil(t, err)
+	assert.Equal(t, []lintResult{
+		{Name: "golint.comment", Code: "comment", Severity: "warning", Path: "main.go", Line: 12, Char: 3, Description: "exported func should have comment"},
+		{Name: "vet", Code: "vet", Severity: "error", Path: "main.go", Line: 20, Description: "unreachable code"},
+	}, lints)
+
+	_, err = parseLintReport("reports/checkstyle.xml", []byte("not xml"), "")
+	assert.NotNil(t, err)
+}
+
+func TestParseJSONLint(t *testing.T) {
+	lints, err := parseLintReport("lint.json", []byte(`[{"name": "eslint", "code": "no-undef", "severity": "error", "path": "/src/a.js", "line": 4}]`), "/src/")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(lints))
+	assert.Equal(t, "a.js", lints[0].Path)
+	assert.Equal(t, "no-undef", lints[0].Code)
+}
+
+func TestGlobMatch(t *testing.T) {
+	assert.True(t, globMatch("**/checkstyle*.xml", "checkstyle.xml"))
+	assert.True(t, globMatch("**/checkstyle*.xml", "home/reports/checkstyle-go.xml"))
+	assert.True(t, globMatch("**/junit*.xml", "/tmp/circle-artifacts/junit.xml"))
+	assert.False(t, globMatch("**/checkstyle*.xml", "home/reports/checkstyle.json"))
+	assert.True(t, globMatch("reports/*.xml", "reports/a.xml"))
+	assert.False(t, globMatch("reports/*.xml", "reports/sub/a.xml"))
+
+	matched := matchingArtifacts([]ciArtifact{{Path: "a/lint.json"}, {Path: "a/out.txt"}}, defaultLintArtifacts)
+	assert.Equal(t, []ciArtifact{{Path: "a/lint.json"}}, matched)
+}
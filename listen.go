@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// serveHTTP listens on addr and serves h in the background until the listener is closed
+func serveHTTP(addr string, h http.Handler) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, wraperr(err, "cannot listen on %s", addr)
+	}
+	go func() {
+		// Serve always returns an error once the listener is closed
+		_ = http.Serve(l, h)
+	}()
+	return l, nil
+}
+
+// closeListener stops a listener from serveHTTP.  l is nil if listening never started.
+func closeListener(l net.Listener) error {
+	if l == nil {
+		return nil
+	}
+	return l.Close()
+}
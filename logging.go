@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelInfo logLevel = iota
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %s", name)
+}
+
+// leveledLogger is a logger that can also log warnings and errors.  Printf logs at info.
+type leveledLogger interface {
+	logger
+	Warnf(string, ...interface{})
+	Errorf(string, ...interface{})
+}
+
+// jsonLogger writes each line as a JSON object, with the fields attached to the logger.  Handling
+// a message attaches the message's IDs, so every line about one build can be found together.
+type jsonLogger struct {
+	out      io.Writer
+	minLevel logLevel
+	fields   map[string]interface{}
+	now      func() time.Time
+}
+
+func newJSONLogger(out io.Writer, name string, minLevel logLevel) *jsonLogger {
+	return &jsonLogger{
+		out:      out,
+		minLevel: minLevel,
+		fields:   map[string]interface{}{"logger": name},
+		now:      time.Now,
+	}
+}
+
+// with returns a logger that adds fields to every line.  Empty and zero fields are left out.
+func (j *jsonLogger) with(fields map[string]interface{}) *jsonLogger {
+	ret := *j
+	ret.fields = make(map[string]interface{}, len(j.fields)+len(fields))
+	for k, v := range j.fields {
+		ret.fields[k] = v
+	}
+	for k, v := range fields {
+		if v == "" || v == 0 {
+			continue
+		}
+		ret.fields[k] = v
+	}
+	return &ret
+}
+
+func (j *jsonLogger) log(level logLevel, format string, args ...interface{}) {
+	if level < j.minLevel {
+		return
+	}
+	line := make(map[string]interface{}, len(j.fields)+3)
+	for k, v := range j.fields {
+		line[k] = v
+	}
+	line["time"] = j.now().UTC().Format(time.RFC3339Nano)
+	line["level"] = logLevelNames[level]
+	line["msg"] = fmt.Sprintf(format, args...)
+	b, err := json.Marshal(line)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"level": "error", "msg": "cannot encode log line: " + err.Error()})
+	}
+	// One write per line, so lines from different goroutines do not interleave
+	j.out.Write(append(b, '\n'))
+}
+
+func (j *jsonLogger) Printf(format string, args ...interface{}) {
+	j.log(levelInfo, format, args...)
+}
+
+func (j *jsonLogger) Warnf(format string, args ...interface{}) {
+	j.log(levelWarn, format, args...)
+}
+
+func (j *jsonLogger) Errorf(format string, args ...interface{}) {
+	j.log(levelError, format, args...)
+}
+
+// withLogFields adds fields to l if it is structured.  Other loggers are returned unchanged.
+func withLogFields(l logger, fields map[string]interface{}) logger {
+	if j, ok := l.(*jsonLogger); ok {
+		return j.with(fields)
+	}
+	return l
+}
+
+// warnf logs a warning if l has levels, otherwise a plain line
+func warnf(l logger, format string, args ...interface{}) {
+	if ll, ok := l.(leveledLogger); ok {
+		ll.Warnf(format, args...)
+		return
+	}
+	l.Printf(format, args...)
+}
+
+// logFielder is a parsed message that knows the IDs to attach to log lines about it
+type logFielder interface {
+	logFields() map[string]interface{}
+}
+
+// messageLogFields are the correlation fields for a parsed message
+func messageLogFields(m parsedMessage) map[string]interface{} {
+	ret := map[string]interface{}{}
+	if f, ok := m.(logFielder); ok {
+		ret = f.logFields()
+	}
+	if orig := m.OriginalMsg(); orig != nil {
+		ret["msg_id"] = orig.ID
+	}
+	return ret
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeLogLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var ret []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &m), line)
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+func TestJSONLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := newJSONLogger(buf, "buildtrigger", levelInfo)
+	l.now = func() time.Time { return time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	withIDs := l.with(map[string]interface{}{"diff": 12, "phid": "PHID-HMBT-1", "revision": 0, "repository": ""})
+	withIDs.Printf("building %s", "now")
+	logIfErr(withIDs, errors.New("nope"), "cannot build")
+	l.Printf("no fields")
+
+	lines := decodeLogLines(t, buf)
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, map[string]interface{}{
+		"time":   "2016-01-02T03:04:05Z",
+		"level":  "info",
+		"logger": "buildtrigger",
+		"msg":    "building now",
+		"diff":   float64(12),
+		"phid":   "PHID-HMBT-1",
+	}, lines[0])
+	assert.Equal(t, "error", lines[1]["level"])
+	assert.Equal(t, "nope: cannot build", lines[1]["msg"])
+	assert.Equal(t, "PHID-HMBT-1", lines[1]["phid"])
+	_, exists := lines[2]["phid"]
+	assert.False(t, exists)
+}
+
+func TestJSONLoggerLevels(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := newJSONLogger(buf, "buildtrigger", levelWarn)
+	l.Printf("hidden")
+	warnf(l, "shown")
+	l.Errorf("also shown")
+	lines := decodeLogLines(t, buf)
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, "warn", lines[0]["level"])
+
+	level, err := parseLogLevel("ERROR")
+	assert.Nil(t, err)
+	assert.Equal(t, levelError, level)
+	_, err = parseLogLevel("loud")
+	assert.NotNil(t, err)
+}
+
+func TestMessageLogFields(t *testing.T) {
+	m := &harbormasterMessage{
+		AllParamTypes: map[string]map[string]string{
+			"querystring": {"diff": "12", "revision": "5", "phid": "PHID-HMBT-1", "callsign": "ABC"},
+		},
+		originalMsg: &message{ID: "msg-1"},
+	}
+	assert.Equal(t, map[string]interface{}{
+		"diff":       12,
+		"revision":   5,
+		"phid":       "PHID-HMBT-1",
+		"repository": "ABC",
+		"msg_id":     "msg-1",
+	}, messageLogFields(m))
+
+	// Loggers without fields are left alone
+	plain := &recordingLogger{}
+	assert.Equal(t, plain, withLogFields(plain, messageLogFields(m)))
+}
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (r *recordingLogger) Printf(format string, args ...interface{}) {
+	r.lines = append(r.lines, format)
+}
@@ -5,8 +5,9 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
@@ -15,6 +16,7 @@ import (
 	"io"
 	"net/url"
 	"strconv"
+	"time"
 )
 
 type verboseLog uint32
@@ -42,9 +44,14 @@ func wraperr(err error, msg string, args ...interface{}) *wrappedError {
 }
 
 func logIfErr(l logger, err error, msg string, args ...interface{}) {
-	if err != nil {
-		l.Printf("%s: %s", err.Error(), fmt.Sprintf(msg, args...))
+	if err == nil {
+		return
+	}
+	if ll, ok := l.(leveledLogger); ok {
+		ll.Errorf("%s: %s", err.Error(), fmt.Sprintf(msg, args...))
+		return
 	}
+	l.Printf("%s: %s", err.Error(), fmt.Sprintf(msg, args...))
 }
 
 type wrappedError struct {
@@ -61,11 +68,11 @@ type logger interface {
 }
 
 type goLogAwsLogger struct {
-	*log.Logger
+	logger
 }
 
 func (g goLogAwsLogger) Log(args ...interface{}) {
-	g.Logger.Println(args...)
+	g.Printf("%s", fmt.Sprint(args...))
 }
 
 type buildTrigger struct {
@@ -77,7 +84,26 @@ type buildTrigger struct {
 	visibilityTimeout int64
 	verbose           bool
 	verboseFile       string
+	listenAddr        string
+	webhookSecret     string
+	maxAttempts       int64
+	retryDelay        time.Duration
+	retryMaxDelay     time.Duration
+	deadLetterQueue   string
+	workers           int
+	repoConfigFile    string
+	buildStoreFile    string
+	buildTimeout      time.Duration
+	logLevel          string
+	metricsAddr       string
+	shutdownTimeout   time.Duration
+	minLogLevel       logLevel
 	logOut            io.Writer
+
+	// source overrides the SQS queue messages are read from
+	source messageSource
+	// signals overrides the OS signals that start a graceful shutdown
+	signals <-chan os.Signal
 }
 
 var mainInstance buildTrigger
@@ -93,14 +119,46 @@ func init() {
 	flag.BoolVar(&mainInstance.verbose, "verbose", defaultVerbose, "Enable verbose logging")
 
 	flag.StringVar(&mainInstance.verboseFile, "verbosefile", os.Getenv("BUILD_VERBOSE_FILE"), "File to put verbose logging into")
+	flag.StringVar(&mainInstance.logLevel, "loglevel", os.Getenv("LOG_LEVEL"), "Least severe log level to write: info, warn or error")
 
 	defaultVisibility, _ := strconv.ParseInt(os.Getenv("QUEUE_VISIBILITY"), 10, 64)
 	flag.Int64Var(&mainInstance.visibilityTimeout, "visibility", defaultVisibility, "If non zero, will change how long the message is hidden from other queue requests")
+
+	flag.StringVar(&mainInstance.listenAddr, "listen", os.Getenv("LISTEN_ADDR"), "If set, receive Harbormaster and CircleCI webhooks on this address instead of reading SQS")
+	flag.StringVar(&mainInstance.webhookSecret, "webhooksecret", os.Getenv("WEBHOOK_SECRET"), "Shared secret every webhook must carry when receiving webhooks with -listen")
+	flag.StringVar(&mainInstance.metricsAddr, "metrics", os.Getenv("METRICS_ADDR"), "If set, serve Prometheus metrics at /metrics and health checks at /healthz and /readyz on this address")
+
+	flag.Int64Var(&mainInstance.maxAttempts, "maxattempts", envInt64("MAX_ATTEMPTS", 5), "How many times to try a message before dead lettering it.  Zero retries forever")
+	flag.DurationVar(&mainInstance.retryDelay, "retrydelay", envDuration("RETRY_DELAY", time.Second*30), "How long to hide a message after its first failure.  Doubles each attempt")
+	flag.DurationVar(&mainInstance.retryMaxDelay, "retrymaxdelay", envDuration("RETRY_MAX_DELAY", time.Minute*15), "Longest time to hide a failed message")
+	flag.StringVar(&mainInstance.deadLetterQueue, "deadletter", os.Getenv("DEAD_LETTER_QUEUE"), "SQS queue URL for messages that run out of attempts")
+
+	flag.StringVar(&mainInstance.repoConfigFile, "repoconfig", os.Getenv("REPO_CONFIG"), "JSON file with per repository settings, such as which CI provider to use")
+	flag.StringVar(&mainInstance.buildStoreFile, "buildstore", os.Getenv("BUILD_STORE"), "JSON file recording every build triggered, kept across restarts")
+	flag.DurationVar(&mainInstance.buildTimeout, "buildtimeout", envDuration("BUILD_TIMEOUT", time.Hour*2), "How long a build may go without reporting back before it is checked on and failed.  Zero disables the check")
+
+	flag.DurationVar(&mainInstance.shutdownTimeout, "shutdowntimeout", envDuration("SHUTDOWN_TIMEOUT", time.Second*25), "How long running messages may take to finish after SIGTERM or SIGINT before they are released to another instance")
+	flag.IntVar(&mainInstance.workers, "workers", int(envInt64("WORKERS", 4)), "How many messages to execute at once.  Messages for the same repository always run one at a time")
+}
+
+func envInt64(name string, defaultVal int64) int64 {
+	if v, err := strconv.ParseInt(os.Getenv(name), 10, 64); err == nil {
+		return v
+	}
+	return defaultVal
+}
+
+func envDuration(name string, defaultVal time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return v
+	}
+	return defaultVal
 }
 
 func main() {
 	flag.Parse()
-	exitOnErr(mainInstance.main(), os.Exit)
+	err := mainInstance.main()
+	exitOnErr(mainInstance.redactor().redactError(err), os.Exit)
 }
 
 func exitOnErr(err error, osExit func(int)) {
@@ -113,7 +171,7 @@ func exitOnErr(err error, osExit func(int)) {
 func (c *buildTrigger) getAwsConfig(out io.Writer) *aws.Config {
 	var logger aws.Logger
 	if out != ioutil.Discard {
-		logger = goLogAwsLogger{log.New(out, "[aws-go]", log.LstdFlags)}
+		logger = goLogAwsLogger{newJSONLogger(out, "aws-go", c.minLogLevel)}
 	}
 	return &aws.Config{
 		Region: &c.region,
@@ -125,6 +183,12 @@ var errPleaseSpecifyRegion = errors.New("please specify a region")
 var errPleaseSpecifyQueue = errors.New("please specify a queue URL")
 var errPleaseSpecifyAPIToken = errors.New("please specify API token")
 
+// redactor scrubs the Phabricator and CircleCI tokens, and the webhook secret, from log output
+// and errors
+func (c *buildTrigger) redactor() *redactor {
+	return newRedactor(c.apiToken, c.circleToken, c.webhookSecret)
+}
+
 func (c *buildTrigger) parseFlags() error {
 	c.logOut = ioutil.Discard
 	if c.verbose {
@@ -137,52 +201,120 @@ func (c *buildTrigger) parseFlags() error {
 			MaxBackups: 3,
 		}
 	}
-	if c.region == "" {
+	if c.logLevel != "" {
+		level, err := parseLogLevel(c.logLevel)
+		if err != nil {
+			return err
+		}
+		c.minLogLevel = level
+	}
+	if c.logOut != ioutil.Discard {
+		c.logOut = &redactingWriter{
+			r:   c.redactor(),
+			out: c.logOut,
+		}
+	}
+	if (c.usesSQS() || c.deadLetterQueue != "") && c.region == "" {
 		return errPleaseSpecifyRegion
 	}
-	if c.queueURL == "" {
+	if c.usesSQS() && c.queueURL == "" {
 		return errPleaseSpecifyQueue
 	}
 	if c.apiToken == "" {
 		return errPleaseSpecifyAPIToken
 	}
+	if c.listenAddr != "" && c.webhookSecret == "" {
+		return errors.New("please specify a webhook secret to receive webhooks")
+	}
 	if c.circleToken == "" {
 		return errors.New("please specify a cirlce token")
 	}
+	policy := c.retryPolicy()
+	if err := policy.validate(); err != nil {
+		return err
+	}
 	return nil
 }
 
-func (c *buildTrigger) processParsedMessages(ctx context.Context, parsedMsgs chan parsedMessage, msgsFailedToProcess chan parsedMessage, msgToDeleteChan chan *sqs.Message, scriptLogger logger) error {
-	for m := range parsedMsgs {
+func (c *buildTrigger) retryPolicy() retryPolicy {
+	return retryPolicy{
+		maxAttempts: c.maxAttempts,
+		baseDelay:   c.retryDelay,
+		maxDelay:    c.retryMaxDelay,
+	}
+}
+
+func (c *buildTrigger) usesSQS() bool {
+	return c.source == nil && c.listenAddr == ""
+}
+
+func (c *buildTrigger) processParsedMessages(ctx context.Context, parsedMsgs chan parsedMessage, msgsFailedToProcess chan failedMessage, msgToDeleteChan chan *message) error {
+	pool := newWorkerPool(c.workers, func(ctx context.Context, m parsedMessage) {
+		l := withLogFields(getLog(ctx), messageLogFields(m))
+		ctx = setLog(ctx, l)
 		if err := m.Execute(ctx); err != nil {
-			scriptLogger.Printf("Error executing message: %s", err.Error())
-			msgsFailedToProcess <- m
-			continue
+			logIfErr(l, err, "Error executing message")
+			metrics.failed.WithLabelValues(messageType(m)).Inc()
+			msgsFailedToProcess <- failedMessage{msg: m, err: err, log: l}
+			return
 		}
-		scriptLogger.Printf("Yay the message was processed correctly!  I should probably delete %s", *m.OriginalMsg().MessageId)
+		metrics.executed.WithLabelValues(messageType(m)).Inc()
+		l.Printf("Yay the message was processed correctly!  I should probably delete %s", m.OriginalMsg().ID)
 		msgToDeleteChan <- m.OriginalMsg()
-	}
+	})
+	pool.run(ctx, parsedMsgs)
 	return nil
 }
 
+func (c *buildTrigger) messageSource(scriptLogger logger, deleteMsgLogger logger) (messageSource, error) {
+	if c.source != nil {
+		return c.source, nil
+	}
+	if c.listenAddr != "" {
+		wr := newWebhookReceiver(scriptLogger, c.webhookSecret)
+		if err := wr.listen(c.listenAddr); err != nil {
+			return nil, err
+		}
+		scriptLogger.Printf("Listening for webhooks on %s", wr.listener.Addr())
+		return wr, nil
+	}
+	return &sqsSource{
+		service:           sqs.New(c.getAwsConfig(c.logOut)),
+		queueURL:          c.queueURL,
+		visibilityTimeout: c.visibilityTimeout,
+		waitTimeSeconds:   20,
+		msgRemoveLog:      deleteMsgLogger,
+	}, nil
+}
+
+func (c *buildTrigger) deadLetterSink() deadLetterSink {
+	if c.deadLetterQueue == "" {
+		return nil
+	}
+	return &sqsDeadLetter{
+		service:  sqs.New(c.getAwsConfig(c.logOut)),
+		queueURL: c.deadLetterQueue,
+		secrets:  c.redactor(),
+	}
+}
+
 func (c *buildTrigger) main() error {
 	if err := c.parseFlags(); err != nil {
 		return err
 	}
-	scriptLogger := log.New(c.logOut, "[buildtrigger]", log.LstdFlags)
-	deleteMsgLogger := log.New(c.logOut, "[delete-msg]", log.LstdFlags)
+	scriptLogger := newJSONLogger(c.logOut, "buildtrigger", c.minLogLevel)
+	deleteMsgLogger := newJSONLogger(c.logOut, "delete-msg", c.minLogLevel)
 	phabURL, err := url.Parse(c.phaburl)
 	if err != nil {
 		return wraperr(err, "cannot parse phab URL")
 	}
 	scriptLogger.Printf("Starting up")
 	ctx := setLog(context.Background(), scriptLogger)
-	cfg := c.getAwsConfig(c.logOut)
-	ch := make(chan *sqs.Message)
-	invalidMessages := make(chan *sqs.Message)
-	msgsFailedToProcess := make(chan parsedMessage)
+	ch := make(chan *message)
+	invalidMessages := make(chan *message)
+	msgsFailedToProcess := make(chan failedMessage)
 	parsedMsgs := make(chan parsedMessage)
-	msgToDeleteChan := make(chan *sqs.Message)
+	msgToDeleteChan := make(chan *message)
 
 	go func() {
 		for m := range invalidMessages {
@@ -191,14 +323,12 @@ func (c *buildTrigger) main() error {
 		}
 	}()
 
+	poolDone := make(chan struct{})
 	go func() {
-		for m := range msgsFailedToProcess {
-			scriptLogger.Printf("A messaged failed to process.  Let's ignore it and try again? %s", *m.OriginalMsg().MessageId)
-		}
+		logIfErr(scriptLogger, c.processParsedMessages(ctx, parsedMsgs, msgsFailedToProcess, msgToDeleteChan), "cannot process parsed messages")
+		close(poolDone)
 	}()
 
-	go c.processParsedMessages(ctx, parsedMsgs, msgsFailedToProcess, msgToDeleteChan, scriptLogger)
-
 	tmpDir, err := ioutil.TempDir("", "buildtrigger")
 	if err != nil {
 		return wraperr(err, "cannot create temp directory for github publisher")
@@ -211,35 +341,137 @@ func (c *buildTrigger) main() error {
 	phab := &phabricatorConduit{
 		apiToken: c.apiToken,
 		url:      phabURL,
+		secrets:  c.redactor(),
 	}
 
 	gp := githubPusher{
 		phab:   phab,
 		tmpDir: tmpDir,
-		cc: &circleClient{
-			token: c.circleToken,
+	}
+
+	cc := &circleClient{
+		token: c.circleToken,
+	}
+
+	configs, err := loadRepoConfigs(c.repoConfigFile)
+	if err != nil {
+		return err
+	}
+	cc2 := &circleV2Client{
+		token: c.circleToken,
+	}
+	ci := &ciRegistry{
+		configs: configs,
+		providers: map[string]ciProvider{
+			defaultCIProvider: cc,
+			circleV2Provider:  cc2,
 		},
 	}
+	if err := ci.validate(); err != nil {
+		return err
+	}
+
+	builds, err := loadBuildTracker(scriptLogger, c.buildStoreFile)
+	if err != nil {
+		return err
+	}
+	metrics.inFlight.set(func() float64 {
+		return float64(builds.inFlight())
+	})
+
+	receives := &receiveStatus{}
+	if c.metricsAddr != "" {
+		status := newStatusServer(scriptLogger)
+		status.secrets = c.redactor()
+		status.addCheck("receive", receives.check)
+		status.addCheck("conduit", phab.ping)
+		status.addCheck("circleci", cc.me)
+		status.addCheck("git", gp.checkWritable)
+		if err := status.listen(c.metricsAddr); err != nil {
+			return err
+		}
+		scriptLogger.Printf("Serving metrics and health checks on %s", status.listener.Addr())
+		defer func() {
+			logIfErr(scriptLogger, status.Close(), "cannot close status listener")
+		}()
+	}
 
 	cp := circleManager{
-		git:  &gp,
-		phab: phab,
-		ci:   gp.cc,
+		git:     &gp,
+		phab:    phab,
+		ci:      ci,
+		configs: configs,
+		builds:  builds,
+	}
+
+	cp2 := circleV2Manager{
+		results: &cp,
+		client:  cc2,
 	}
 
+	// The watchdog also moves queued builds to running, so it runs even if builds never time out
+	w := buildWatchdog{
+		builds:  builds,
+		ci:      ci,
+		results: cp,
+		timeout: c.buildTimeout,
+	}
+	watchdogCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go w.run(watchdogCtx)
+
 	hp := harbormasterPublisher{
-		gp: &gp,
+		gp:     &gp,
+		ci:     ci,
+		builds: builds,
 	}
 
-	mp := newMsgProcessor(ch, invalidMessages, parsedMsgs, []msgConstructor{hp.parseHarbormasterMsg, cp.parseCircleCImsg})
+	mp := newMsgProcessor(ch, invalidMessages, parsedMsgs, []msgConstructor{hp.parseHarbormasterMsg, cp.parseCircleCImsg, cp2.parseCircleCIv2msg})
 
-	q := queuePoller{
-		cfg:               cfg,
-		queueURL:          c.queueURL,
-		visibilityTimeout: c.visibilityTimeout,
-		waitTimeSeconds:   20,
-		msgRemoveLog:      deleteMsgLogger,
+	source, err := c.messageSource(scriptLogger, deleteMsgLogger)
+	if err != nil {
+		return err
+	}
+	if wr, ok := source.(*webhookReceiver); ok && c.source == nil {
+		defer func() {
+			logIfErr(scriptLogger, wr.Close(), "cannot close webhook listener")
+		}()
+	}
+
+	inFlight := newInFlightMessages()
+	if sqsSrc, ok := source.(*sqsSource); ok {
+		timeout, err := sqsSrc.queueVisibilityTimeout()
+		switch {
+		case err != nil:
+			// The bridge still works without the heartbeat, so a missing permission only disables it
+			warnf(scriptLogger, "Cannot read the queue visibility timeout.  Messages being processed will not be kept hidden: %s", err.Error())
+			timeout = 0
+		case timeout <= 0:
+			warnf(scriptLogger, "Queue visibility timeout is 0.  Messages being processed will not be kept hidden")
+		}
+		h := visibilityHeartbeat{
+			inFlight: inFlight,
+			source:   source,
+			timeout:  timeout,
+		}
+		heartbeatCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go h.run(heartbeatCtx)
+	}
+	rt := retrier{
+		source:          source,
+		deadLetters:     c.deadLetterSink(),
+		msgToDeleteChan: msgToDeleteChan,
+		inFlight:        inFlight,
+		log:             scriptLogger,
+		policy:          c.retryPolicy(),
+	}
+	go rt.processFailures(ctx, msgsFailedToProcess)
 
+	q := queuePoller{
+		source:          source,
+		receives:        receives,
+		inFlight:        inFlight,
 		msgInputChan:    ch,
 		msgToDeleteChan: msgToDeleteChan,
 	}
@@ -249,14 +481,25 @@ func (c *buildTrigger) main() error {
 	if err := mp.Start(ctx); err != nil {
 		return err
 	}
+	signals := c.signals
+	if signals == nil {
+		osSignals := make(chan os.Signal, 1)
+		signal.Notify(osSignals, syscall.SIGTERM, syscall.SIGINT)
+		defer signal.Stop(osSignals)
+		signals = osSignals
+	}
 	scriptLogger.Printf("Goroutines started")
-	<-q.Done()
-	if err := q.Err(); err != nil {
+	select {
+	case <-q.Done():
+	case sig := <-signals:
+		scriptLogger.Printf("Got %s.  Shutting down", sig)
+		return c.shutdown(ctx, &q, mp, parsedMsgs, poolDone, inFlight, source)
+	}
+	if err := q.Err(); err != nil && err != errMessageSourceClosed {
 		return err
 	}
 	scriptLogger.Printf("q done")
-	<-mp.Done()
-	if err := mp.Err(); err != nil {
+	if err := mp.Close(); err != nil {
 		return err
 	}
 	scriptLogger.Printf("mp done")
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var exampleNonPhabCirclePost = `{
+    "allParamsJson": {},
+    "formparams": {
+        "payload": {
+            "branch": "master",
+            "build_num": 12,
+            "build_url": "https://circleci.com/gh/signalfx/arepo/12",
+            "outcome": "success",
+            "reponame": "arepo",
+            "username": "signalfx",
+            "vcs_url": "https://github.com/signalfx/arepo",
+            "build_parameters": {
+                "phid": "PHID-HMBT-abc"
+            }
+        }
+    }
+}`
+
+func waitForDeletes(t *testing.T, src *memorySource, count int) {
+	for i := 0; i < 500; i++ {
+		if len(src.Deleted()) >= count {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("timed out waiting for %d deletes, got %d", count, len(src.Deleted()))
+}
+
+func TestMainWithMemorySource(t *testing.T) {
+	src := newMemorySource()
+	bt := buildTrigger{
+		apiToken:      "api-token",
+		circleToken:   "circle-token",
+		phaburl:       "http://127.0.0.1",
+		source:        src,
+		retryDelay:    time.Second,
+		retryMaxDelay: time.Minute,
+	}
+	mainErr := make(chan error)
+	go func() {
+		mainErr <- bt.main()
+	}()
+
+	invalid := src.Send(`{"hello": "world"}`)
+	valid := src.Send(exampleNonPhabCirclePost)
+	waitForDeletes(t, src, 2)
+	assert.Contains(t, src.Deleted(), invalid)
+	assert.Contains(t, src.Deleted(), valid)
+
+	assert.Nil(t, src.Close())
+	assert.Nil(t, <-mainErr)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// latencyBuckets are the histogram buckets, in seconds, for HTTP calls and git commands
+var latencyBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// gaugeSource is the function a gauge is read from.  It is set once the thing it measures exists,
+// which is after the gauge is registered.
+type gaugeSource struct {
+	mu sync.Mutex
+	fn func() float64
+}
+
+func (g *gaugeSource) set(fn func() float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.fn = fn
+}
+
+func (g *gaugeSource) value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.fn == nil {
+		return 0
+	}
+	return g.fn()
+}
+
+// bridgeMetrics are the counters and histograms the bridge exports, kept in their own registry
+type bridgeMetrics struct {
+	registry       *prometheus.Registry
+	received       prometheus.Counter
+	parsed         *prometheus.CounterVec
+	invalid        prometheus.Counter
+	executed       *prometheus.CounterVec
+	failed         *prometheus.CounterVec
+	deleted        prometheus.Counter
+	conduitCalls   *prometheus.CounterVec
+	conduitLatency *prometheus.HistogramVec
+	circleCalls    *prometheus.CounterVec
+	circleLatency  *prometheus.HistogramVec
+	gitDuration    *prometheus.HistogramVec
+	inFlight       *gaugeSource
+}
+
+func newBridgeMetrics() *bridgeMetrics {
+	m := &bridgeMetrics{
+		registry: prometheus.NewRegistry(),
+		received: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "buildtrigger_messages_received_total",
+			Help: "Messages received from the message source",
+		}),
+		parsed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "buildtrigger_messages_parsed_total",
+			Help: "Messages parsed, by message type",
+		}, []string{"type"}),
+		invalid: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "buildtrigger_messages_invalid_total",
+			Help: "Messages no parser understood",
+		}),
+		executed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "buildtrigger_messages_executed_total",
+			Help: "Messages executed successfully, by message type",
+		}, []string{"type"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "buildtrigger_messages_failed_total",
+			Help: "Messages whose execution failed, by message type",
+		}, []string{"type"}),
+		deleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "buildtrigger_messages_deleted_total",
+			Help: "Messages deleted from the message source",
+		}),
+		conduitCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "buildtrigger_conduit_requests_total",
+			Help: "Conduit calls, by method and HTTP status code",
+		}, []string{"method", "code"}),
+		conduitLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "buildtrigger_conduit_request_duration_seconds",
+			Help:    "Conduit call latency, by method",
+			Buckets: latencyBuckets,
+		}, []string{"method"}),
+		circleCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "buildtrigger_circleci_requests_total",
+			Help: "CircleCI API calls, by HTTP method and status code",
+		}, []string{"method", "code"}),
+		circleLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "buildtrigger_circleci_request_duration_seconds",
+			Help:    "CircleCI API call latency, by HTTP method",
+			Buckets: latencyBuckets,
+		}, []string{"method"}),
+		gitDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "buildtrigger_git_command_duration_seconds",
+			Help:    "git command durations, by subcommand and result",
+			Buckets: latencyBuckets,
+		}, []string{"command", "result"}),
+		inFlight: &gaugeSource{},
+	}
+	m.registry.MustRegister(
+		m.received, m.parsed, m.invalid, m.executed, m.failed, m.deleted,
+		m.conduitCalls, m.conduitLatency, m.circleCalls, m.circleLatency, m.gitDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "buildtrigger_builds_in_flight",
+			Help: "Builds scheduled that have not reported a result",
+		}, m.inFlight.value),
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// handler serves every metric in the Prometheus exposition format
+func (m *bridgeMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// metrics is where the bridge's components record what they do
+var metrics = newBridgeMetrics()
+
+// statusCode is the label for an HTTP call's outcome.  Calls that got no response are "error".
+func statusCode(resp *http.Response) string {
+	if resp == nil {
+		return "error"
+	}
+	return strconv.Itoa(resp.StatusCode)
+}
+
+// messageType names a parsed message's type for metrics
+func messageType(m parsedMessage) string {
+	switch m.(type) {
+	case *harbormasterMessage:
+		return "harbormaster"
+	case *circleCiMsg:
+		return "circleci"
+	case *circleV2Msg:
+		return "circleci-v2"
+	}
+	return "unknown"
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestGaugeSource(t *testing.T) {
+	g := &gaugeSource{}
+	assert.Equal(t, 0.0, g.value())
+	g.set(func() float64 { return 3 })
+	assert.Equal(t, 3.0, g.value())
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	p, server, _ := newTestConduit(t, `{"result": {}, "error_code": null, "error_info": null}`)
+	defer server.Close()
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	calls := metrics.conduitCalls.WithLabelValues("harbormaster.createartifact", "200")
+	before := testutil.ToFloat64(calls)
+	assert.Nil(t, p.createURIArtifact(ctx, "PHID-HMBT-1", "k", "n", "https://example.com"))
+	assert.Equal(t, before+1, testutil.ToFloat64(calls))
+
+	status := httptest.NewServer(newStatusServer(log.New(ioutil.Discard, "", 0)).Handler())
+	defer status.Close()
+	resp, err := http.Get(status.URL + "/metrics")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"))
+	assert.Contains(t, string(body), `buildtrigger_conduit_requests_total{code="200",method="harbormaster.createartifact"}`)
+	assert.Contains(t, string(body), "# TYPE buildtrigger_builds_in_flight gauge")
+	assert.Contains(t, string(body), "# TYPE go_goroutines gauge")
+}
+
+func TestMessageType(t *testing.T) {
+	assert.Equal(t, "harbormaster", messageType(&harbormasterMessage{}))
+	assert.Equal(t, "circleci", messageType(&circleCiMsg{}))
+	assert.Equal(t, "circleci-v2", messageType(&circleV2Msg{}))
+	assert.Equal(t, "unknown", messageType(&failingMsg{}))
+}
@@ -1,21 +1,23 @@
 package main
 
 import (
-	"github.com/aws/aws-sdk-go/service/sqs"
 	"golang.org/x/net/context"
 )
 
 type parsedMessage interface {
 	LooksValid() bool
 	Execute(context.Context) error
-	OriginalMsg() *sqs.Message
+	OriginalMsg() *message
+	// SerializationKey groups messages that must not execute at the same time.  Empty means the
+	// message can run alongside anything.
+	SerializationKey() string
 }
 
-type msgConstructor func(*sqs.Message) (parsedMessage, error)
+type msgConstructor func(*message) (parsedMessage, error)
 
 type msgProcessor struct {
-	ch              <-chan *sqs.Message
-	invalidMessages chan<- *sqs.Message
+	ch              <-chan *message
+	invalidMessages chan<- *message
 	parsedMsgs      chan<- parsedMessage
 
 	closeSignal chan struct{}
@@ -24,7 +26,7 @@ type msgProcessor struct {
 	parsers     []msgConstructor
 }
 
-func newMsgProcessor(ch <-chan *sqs.Message, invalidMessages chan<- *sqs.Message, parsedMsgs chan<- parsedMessage, parsers []msgConstructor) *msgProcessor {
+func newMsgProcessor(ch <-chan *message, invalidMessages chan<- *message, parsedMsgs chan<- parsedMessage, parsers []msgConstructor) *msgProcessor {
 	return &msgProcessor{
 		ch:              ch,
 		invalidMessages: invalidMessages,
@@ -48,7 +50,7 @@ func (m *msgProcessor) Start(ctx context.Context) error {
 	return nil
 }
 
-func (m *msgProcessor) Input() <-chan *sqs.Message {
+func (m *msgProcessor) Input() <-chan *message {
 	return m.ch
 }
 
@@ -66,9 +68,10 @@ func (m *msgProcessor) Err() error {
 	return m.runErr
 }
 
-func (m *msgProcessor) onMessage(ctx context.Context, msg *sqs.Message) error {
+func (m *msgProcessor) onMessage(ctx context.Context, msg *message) error {
 	for _, p := range m.parsers {
 		if parsed, err := p(msg); err == nil {
+			metrics.parsed.WithLabelValues(messageType(parsed)).Inc()
 			select {
 			case m.parsedMsgs <- parsed:
 			case <-ctx.Done():
@@ -79,6 +82,7 @@ func (m *msgProcessor) onMessage(ctx context.Context, msg *sqs.Message) error {
 			return nil
 		}
 	}
+	metrics.invalid.Inc()
 	select {
 	case m.invalidMessages <- msg:
 	case <-ctx.Done():
@@ -95,8 +99,10 @@ func (m *msgProcessor) processMessages(ctx context.Context) error {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-m.closeSignal:
+			return nil
 		case msg := <-m.ch:
-			l.Printf("A message from chan: %s", *msg.MessageId)
+			l.Printf("A message from chan: %s", msg.ID)
 			if err := m.onMessage(ctx, msg); err != nil {
 				return err
 			}
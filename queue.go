@@ -1,24 +1,35 @@
 package main
 
 import (
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/sqs"
 	"golang.org/x/net/context"
 	"sync"
+	"time"
+)
+
+// Bounds of the wait after a failed Receive.  The poller keeps trying, so /readyz reports the
+// failure through receiveStatus instead of the process exiting.
+const (
+	receiveBackoff    = time.Second
+	maxReceiveBackoff = time.Minute
 )
 
 type queuePoller struct {
-	cfg               *aws.Config
-	queueURL          string
-	waitTimeSeconds   int64
-	msgRemoveLog      logger
-	visibilityTimeout int64
+	source   messageSource
+	receives *receiveStatus
+	inFlight *inFlightMessages
+	// backoff is the first wait after a failed Receive, receiveBackoff if zero
+	backoff time.Duration
 
-	msgInputChan    chan<- *sqs.Message
-	msgToDeleteChan <-chan *sqs.Message
+	msgInputChan    chan<- *message
+	msgToDeleteChan <-chan *message
 
 	closeSignal chan struct{}
 	doneSignal  chan struct{}
+	// stopReceiveSignal stops receiving while deletes keep flowing
+	stopReceiveSignal chan struct{}
+	// flushSignal makes removeMessages finish the deletes already sent, then return
+	flushSignal chan struct{}
+	deletesDone chan struct{}
 
 	runErr error
 }
@@ -63,6 +74,9 @@ func (q *queuePoller) Start(ctx context.Context) error {
 
 	q.closeSignal = make(chan struct{})
 	q.doneSignal = make(chan struct{})
+	q.stopReceiveSignal = make(chan struct{})
+	q.flushSignal = make(chan struct{})
+	q.deletesDone = make(chan struct{})
 
 	go func() {
 		q.runErr = runInCtx(ctx, q.removeMessages, q.drainMessages)
@@ -85,42 +99,79 @@ func (q *queuePoller) Err() error {
 	return q.runErr
 }
 
+// stopReceiving stops receiving new messages.  Messages already received are still forwarded
+// until Close, and deletes keep flowing until flushDeletes or Close.  Call it at most once.
+func (q *queuePoller) stopReceiving() {
+	close(q.stopReceiveSignal)
+}
+
+// flushDeletes deletes the messages already waiting to be deleted, then stops deleting.  It does
+// not wait for a Receive in progress, which may be a long poll.  Call it at most once.
+func (q *queuePoller) flushDeletes() {
+	close(q.flushSignal)
+	<-q.deletesDone
+}
+
 func (q *queuePoller) removeMessages(ctx context.Context) error {
-	service := sqs.New(q.cfg)
+	defer close(q.deletesDone)
 	for {
 		select {
 		case <-q.closeSignal:
 			return nil
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-q.flushSignal:
+			return q.removePending(ctx)
 		case msgToRemove, ok := <-q.msgToDeleteChan:
 			if !ok {
 				return nil
 			}
-			input := sqs.DeleteMessageInput{
-				QueueUrl:      &q.queueURL,
-				ReceiptHandle: msgToRemove.ReceiptHandle,
+			if err := q.remove(ctx, msgToRemove); err != nil {
+				return err
 			}
-			out, err := service.DeleteMessage(&input)
-			if err != nil {
-				return wraperr(err, "unable to delete a message")
+		}
+	}
+}
+
+// removePending deletes messages until none are waiting to be deleted.  Failures are only logged,
+// since the poller is stopping anyway.
+func (q *queuePoller) removePending(ctx context.Context) error {
+	for {
+		select {
+		case msgToRemove, ok := <-q.msgToDeleteChan:
+			if !ok {
+				return nil
 			}
-			q.msgRemoveLog.Printf("%s\n", out.GoString())
+			logIfErr(getLog(ctx), q.remove(ctx, msgToRemove), "cannot delete message %s", msgToRemove.ID)
+		default:
+			return nil
 		}
 	}
 }
 
-func (q *queuePoller) forwardMsgs(ctx context.Context, resp *sqs.ReceiveMessageOutput) error {
+func (q *queuePoller) remove(ctx context.Context, m *message) error {
+	// Stop tracking first, so the visibility heartbeat never touches a deleted message
+	q.inFlight.remove(m)
+	if err := q.source.Delete(ctx, m); err != nil {
+		return err
+	}
+	metrics.deleted.Inc()
+	return nil
+}
+
+func (q *queuePoller) forwardMsgs(ctx context.Context, msgs []*message) error {
 	l := getLog(ctx)
-	if len(resp.Messages) == 0 {
+	if len(msgs) == 0 {
 		l.Printf("Got no messages")
 		return nil
 	}
-	for _, m := range resp.Messages {
-		l.Printf("Message: %s", *m.MessageId)
+	for _, m := range msgs {
+		l.Printf("Message: %s", m.ID)
 		select {
 		case <-q.closeSignal:
 			return nil
+		case <-q.stopReceiveSignal:
+			return nil
 		case <-ctx.Done():
 			return ctx.Err()
 		case q.msgInputChan <- m:
@@ -130,28 +181,114 @@ func (q *queuePoller) forwardMsgs(ctx context.Context, resp *sqs.ReceiveMessageO
 }
 
 func (q *queuePoller) drainMessages(ctx context.Context) error {
-	service := sqs.New(q.cfg)
+	// Receive gets a context that ends once receiving stops, so sources that honor it return early
+	receiveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-q.stopReceiveSignal:
+			cancel()
+		case <-receiveCtx.Done():
+		}
+	}()
+	var delay time.Duration
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-q.closeSignal:
 			return nil
+		case <-q.stopReceiveSignal:
+			return nil
 		default:
 		}
-		msg := sqs.ReceiveMessageInput{
-			QueueUrl:        &q.queueURL,
-			WaitTimeSeconds: &q.waitTimeSeconds,
+		msgs, err := q.source.Receive(receiveCtx)
+		q.inFlight.add(msgs...)
+		if q.receivingStopped() {
+			return nil
 		}
-		if q.visibilityTimeout != 0 {
-			msg.VisibilityTimeout = &q.visibilityTimeout
+		if err == errMessageSourceClosed {
+			return err
 		}
-		resp, err := service.ReceiveMessage(&msg)
+		q.receives.record(err)
 		if err != nil {
-			return wraperr(err, "cannot receive messagges from queue")
+			delay = q.nextBackoff(delay)
+			logIfErr(getLog(ctx), err, "cannot receive messages.  Trying again in %s", delay)
+			if keepGoing, err := q.wait(ctx, delay); !keepGoing {
+				return err
+			}
+			continue
 		}
-		if err := q.forwardMsgs(ctx, resp); err != nil {
+		delay = 0
+		metrics.received.Add(float64(len(msgs)))
+		if err := q.forwardMsgs(ctx, msgs); err != nil {
 			return err
 		}
 	}
 }
+
+// nextBackoff doubles the wait after each failed Receive in a row, up to maxReceiveBackoff
+func (q *queuePoller) nextBackoff(last time.Duration) time.Duration {
+	if last == 0 {
+		if q.backoff > 0 {
+			return q.backoff
+		}
+		return receiveBackoff
+	}
+	if last*2 > maxReceiveBackoff {
+		return maxReceiveBackoff
+	}
+	return last * 2
+}
+
+// wait sleeps for d, returning false if the poller should stop instead
+func (q *queuePoller) wait(ctx context.Context, d time.Duration) (bool, error) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-q.closeSignal:
+		return false, nil
+	case <-q.stopReceiveSignal:
+		return false, nil
+	case <-t.C:
+		return true, nil
+	}
+}
+
+func (q *queuePoller) receivingStopped() bool {
+	select {
+	case <-q.stopReceiveSignal:
+		return true
+	default:
+		return false
+	}
+}
+
+// receiveStatus remembers whether the last Receive from the message source worked.  A nil
+// receiveStatus records nothing.
+type receiveStatus struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (r *receiveStatus) record(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+// check returns the error of the last Receive.  The bridge is considered able to receive until a
+// Receive fails.
+func (r *receiveStatus) check(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return wraperr(r.err, "last receive failed")
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// flakySource fails its first failures receives
+type flakySource struct {
+	*memorySource
+	failures int32
+}
+
+func (s *flakySource) Receive(ctx context.Context) ([]*message, error) {
+	if atomic.AddInt32(&s.failures, -1) >= 0 {
+		return nil, errors.New("access denied")
+	}
+	return s.memorySource.Receive(ctx)
+}
+
+func TestPollerRetriesFailedReceive(t *testing.T) {
+	src := &flakySource{memorySource: newMemorySource(), failures: 2}
+	m := src.Send("a")
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	receives := &receiveStatus{}
+	ch := make(chan *message)
+	q := queuePoller{
+		source:          src,
+		receives:        receives,
+		backoff:         time.Millisecond * 10,
+		msgInputChan:    ch,
+		msgToDeleteChan: make(chan *message),
+	}
+	assert.Nil(t, q.Start(ctx))
+	defer q.Close()
+	// Closing the source ends the Receive the poller is waiting in
+	defer src.Close()
+
+	// The failures are reported, and the poller keeps going until a receive works
+	select {
+	case got := <-ch:
+		assert.Equal(t, m, got)
+	case <-time.After(time.Second * 5):
+		t.Fatal("no message after the receive failures")
+	}
+	assert.Nil(t, receives.check(ctx))
+	select {
+	case <-q.Done():
+		t.Fatal("poller stopped after a failed receive")
+	default:
+	}
+}
+
+func TestPollerBackoff(t *testing.T) {
+	q := queuePoller{}
+	assert.Equal(t, receiveBackoff, q.nextBackoff(0))
+	assert.Equal(t, receiveBackoff*2, q.nextBackoff(receiveBackoff))
+	assert.Equal(t, maxReceiveBackoff, q.nextBackoff(maxReceiveBackoff))
+}
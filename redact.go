@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+const redactedText = "[REDACTED]"
+
+// redactor scrubs API tokens out of anything that may end up in a log
+type redactor struct {
+	replacer *strings.Replacer
+}
+
+func newRedactor(secrets ...string) *redactor {
+	pairs := make([]string, 0, len(secrets)*2)
+	for _, s := range secrets {
+		if s != "" {
+			pairs = append(pairs, s, redactedText)
+		}
+	}
+	return &redactor{
+		replacer: strings.NewReplacer(pairs...),
+	}
+}
+
+// redact removes every secret from s.  A nil redactor returns s unchanged.
+func (r *redactor) redact(s string) string {
+	if r == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+// redactError returns err with every secret removed from its message
+func (r *redactor) redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if redacted := r.redact(msg); redacted != msg {
+		return errors.New(redacted)
+	}
+	return err
+}
+
+// redactingWriter scrubs each write before passing it on.  log.Logger writes a whole line at a
+// time, so a secret is never split across writes.
+type redactingWriter struct {
+	r   *redactor
+	out io.Writer
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, w.r.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactor(t *testing.T) {
+	r := newRedactor("api-secret", "", "circle-secret")
+	assert.Equal(t, "token [REDACTED] and [REDACTED]", r.redact("token api-secret and circle-secret"))
+	assert.Nil(t, r.redactError(nil))
+
+	plain := errors.New("nothing to see")
+	assert.Equal(t, plain, r.redactError(plain))
+	wrapped := wraperr(errors.New("GET https://circleci.com/?circle-token=circle-secret"), "cannot GET")
+	assert.Equal(t, "cannot GET: GET https://circleci.com/?circle-token=[REDACTED]", r.redactError(wrapped).Error())
+
+	buf := &bytes.Buffer{}
+	l := log.New(&redactingWriter{r: r, out: buf}, "", 0)
+	l.Printf("posting with api.token=%s", "api-secret")
+	assert.Equal(t, "posting with api.token=[REDACTED]\n", buf.String())
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+const defaultCIProvider = "circleci"
+
+// Comment modes pick which comments the bridge posts to a revision
+const (
+	// commentsAll posts a comment when the build starts and another with the result
+	commentsAll = "all"
+	// commentsResult posts only the result comment, so there is one comment per diff
+	commentsResult = "result"
+	// commentsNone leaves the revision alone.  Everything is reported through Harbormaster.
+	commentsNone = "none"
+	// commentsStatus shows the build's progress on its Harbormaster build target, which goes from
+	// queued to running to finished in place, and posts only the result comment
+	commentsStatus = "status"
+)
+
+// repoConfig is how the bridge treats one repository
+type repoConfig struct {
+	// CI names the ciProvider builds are scheduled on
+	CI string `json:"ci"`
+	// VCS is the VCS type in the CircleCI v2 project slug: gh for GitHub or bb for Bitbucket
+	VCS string `json:"vcs"`
+	// LintArtifacts are globs of checkstyle XML or JSON lint reports among the build's artifacts
+	LintArtifacts []string `json:"lint_artifacts"`
+	// JUnitArtifacts are globs of JUnit XML reports, read when CircleCI has no test metadata
+	JUnitArtifacts []string `json:"junit_artifacts"`
+	// CoverageArtifacts are globs of Go cover profile, LCOV or Cobertura XML coverage reports
+	CoverageArtifacts []string `json:"coverage_artifacts"`
+	// ArtifactPathPrefix is trimmed from file paths in artifacts, to make them relative to the repository
+	ArtifactPathPrefix string `json:"artifact_path_prefix"`
+	// UnitDetailsLimit caps the bytes of test output sent to Harbormaster per test.  Zero sends all of it.
+	UnitDetailsLimit int `json:"unit_details_limit"`
+	// CommentTemplate is a text/template file for the result comment posted to the revision
+	CommentTemplate string `json:"comment_template"`
+	// Comments is the comment mode: commentsAll, commentsResult, commentsStatus or commentsNone
+	Comments string `json:"comments"`
+}
+
+// commentOnStart is whether to tell the revision its build was scheduled
+func (r repoConfig) commentOnStart() bool {
+	return r.Comments == commentsAll
+}
+
+// workWhenRunning is whether the build target is marked working once its build runs, instead of
+// as soon as the build is scheduled
+func (r repoConfig) workWhenRunning() bool {
+	return r.Comments == commentsStatus
+}
+
+// commentOnResult is whether to post the build result to the revision
+func (r repoConfig) commentOnResult() bool {
+	return r.Comments != commentsNone
+}
+
+// repoConfigs is the repository config file.  Repositories are keyed by callsign and fall back
+// to Default for anything they leave unset.
+type repoConfigs struct {
+	Default      repoConfig            `json:"default"`
+	Repositories map[string]repoConfig `json:"repositories"`
+
+	commentTemplates map[string]*template.Template
+}
+
+func loadRepoConfigs(filename string) (*repoConfigs, error) {
+	ret := &repoConfigs{}
+	if filename == "" {
+		return ret, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, wraperr(err, "cannot open repository config %s", filename)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(ret); err != nil {
+		return nil, wraperr(err, "cannot decode repository config %s", filename)
+	}
+	if err := ret.validate(); err != nil {
+		return nil, wraperr(err, "invalid repository config %s", filename)
+	}
+	if err := ret.loadCommentTemplates(filepath.Dir(filename)); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (r *repoConfigs) validate() error {
+	if err := validCommentMode(r.Default.Comments); err != nil {
+		return err
+	}
+	for callsign, c := range r.Repositories {
+		if err := validCommentMode(c.Comments); err != nil {
+			return wraperr(err, "repository %s", callsign)
+		}
+	}
+	return nil
+}
+
+func validCommentMode(mode string) error {
+	switch mode {
+	case "", commentsAll, commentsResult, commentsStatus, commentsNone:
+		return nil
+	}
+	return fmt.Errorf("unknown comment mode %s", mode)
+}
+
+func (r *repoConfigs) forCallsign(callsign string) repoConfig {
+	ret := r.Default
+	if ret.CI == "" {
+		ret.CI = defaultCIProvider
+	}
+	if ret.VCS == "" {
+		ret.VCS = defaultVCS
+	}
+	if ret.Comments == "" {
+		ret.Comments = commentsAll
+	}
+	if ret.LintArtifacts == nil {
+		ret.LintArtifacts = defaultLintArtifacts
+	}
+	if ret.JUnitArtifacts == nil {
+		ret.JUnitArtifacts = defaultJUnitArtifacts
+	}
+	if ret.CoverageArtifacts == nil {
+		ret.CoverageArtifacts = defaultCoverageArtifacts
+	}
+	override, exists := r.Repositories[callsign]
+	if !exists {
+		return ret
+	}
+	if override.CI != "" {
+		ret.CI = override.CI
+	}
+	if override.VCS != "" {
+		ret.VCS = override.VCS
+	}
+	if override.LintArtifacts != nil {
+		ret.LintArtifacts = override.LintArtifacts
+	}
+	if override.JUnitArtifacts != nil {
+		ret.JUnitArtifacts = override.JUnitArtifacts
+	}
+	if override.CoverageArtifacts != nil {
+		ret.CoverageArtifacts = override.CoverageArtifacts
+	}
+	if override.ArtifactPathPrefix != "" {
+		ret.ArtifactPathPrefix = override.ArtifactPathPrefix
+	}
+	if override.UnitDetailsLimit != 0 {
+		ret.UnitDetailsLimit = override.UnitDetailsLimit
+	}
+	if override.CommentTemplate != "" {
+		ret.CommentTemplate = override.CommentTemplate
+	}
+	if override.Comments != "" {
+		ret.Comments = override.Comments
+	}
+	return ret
+}
+
+// ciRegistry picks the ciProvider configured for a repository
+type ciRegistry struct {
+	configs   *repoConfigs
+	providers map[string]ciProvider
+}
+
+func (c *ciRegistry) forCallsign(callsign string) (ciProvider, error) {
+	cfg := c.configs.forCallsign(callsign)
+	p, exists := c.providers[cfg.CI]
+	if !exists {
+		return nil, fmt.Errorf("unknown CI provider %s for repository %s", cfg.CI, callsign)
+	}
+	return p.forRepo(cfg), nil
+}
+
+// validate makes sure every configured repository points at a real provider
+func (c *ciRegistry) validate() error {
+	if _, err := c.forCallsign(""); err != nil {
+		return err
+	}
+	for callsign := range c.configs.Repositories {
+		if _, err := c.forCallsign(callsign); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTempFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "repoconfig")
+	assert.Nil(t, err)
+	_, err = f.WriteString(contents)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	return f.Name()
+}
+
+func TestRepoConfigs(t *testing.T) {
+	filename := writeTempFile(t, `{
+		"repositories": {
+			"ABC": {"ci": "other"},
+			"DEF": {}
+		}
+	}`)
+	defer os.Remove(filename)
+	configs, err := loadRepoConfigs(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, "other", configs.forCallsign("ABC").CI)
+	assert.Equal(t, defaultCIProvider, configs.forCallsign("DEF").CI)
+	assert.Equal(t, defaultCIProvider, configs.forCallsign("XYZ").CI)
+
+	cc := &circleClient{}
+	reg := ciRegistry{
+		configs:   configs,
+		providers: map[string]ciProvider{defaultCIProvider: cc},
+	}
+	assert.NotNil(t, reg.validate())
+	p, err := reg.forCallsign("DEF")
+	assert.Nil(t, err)
+	assert.Equal(t, cc, p)
+
+	reg.providers["other"] = &circleClient{}
+	assert.Nil(t, reg.validate())
+}
+
+func TestRepoConfigsVCS(t *testing.T) {
+	filename := writeTempFile(t, `{
+		"repositories": {
+			"ABC": {"ci": "circleci-v2", "vcs": "bb"},
+			"DEF": {"ci": "circleci-v2"}
+		}
+	}`)
+	defer os.Remove(filename)
+	configs, err := loadRepoConfigs(filename)
+	assert.Nil(t, err)
+	reg := ciRegistry{
+		configs:   configs,
+		providers: map[string]ciProvider{defaultCIProvider: &circleClient{}, circleV2Provider: &circleV2Client{}},
+	}
+	p, err := reg.forCallsign("ABC")
+	assert.Nil(t, err)
+	assert.Equal(t, "bb/signalfx/arepo", p.(*circleV2Client).projectSlug("signalfx", "arepo"))
+	p, err = reg.forCallsign("DEF")
+	assert.Nil(t, err)
+	assert.Equal(t, "gh/signalfx/arepo", p.(*circleV2Client).projectSlug("signalfx", "arepo"))
+}
+
+func TestRepoConfigsMissingFile(t *testing.T) {
+	configs, err := loadRepoConfigs("")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultCIProvider, configs.forCallsign("ABC").CI)
+
+	_, err = loadRepoConfigs("/does/not/exist.json")
+	assert.NotNil(t, err)
+}
+
+func TestCommentModes(t *testing.T) {
+	filename := writeTempFile(t, `{
+		"default": {"comments": "result"},
+		"repositories": {"ABC": {"comments": "none"}, "DEF": {"comments": "status"}}
+	}`)
+	defer os.Remove(filename)
+	configs, err := loadRepoConfigs(filename)
+	assert.Nil(t, err)
+	assert.False(t, configs.forCallsign("XYZ").commentOnStart())
+	assert.True(t, configs.forCallsign("XYZ").commentOnResult())
+	assert.False(t, configs.forCallsign("ABC").commentOnResult())
+	assert.False(t, configs.forCallsign("XYZ").workWhenRunning())
+
+	status := configs.forCallsign("DEF")
+	assert.False(t, status.commentOnStart())
+	assert.True(t, status.commentOnResult())
+	assert.True(t, status.workWhenRunning())
+
+	assert.True(t, (&repoConfigs{}).forCallsign("XYZ").commentOnStart())
+
+	bad := writeTempFile(t, `{"repositories": {"ABC": {"comments": "sometimes"}}}`)
+	defer os.Remove(bad)
+	_, err = loadRepoConfigs(bad)
+	assert.NotNil(t, err)
+}
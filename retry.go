@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// failedMessage is a parsed message whose Execute returned an error.  log carries the message's
+// correlation fields, so the retry or dead letter lines can be matched to the failure.
+type failedMessage struct {
+	msg parsedMessage
+	err error
+	log logger
+}
+
+// permanentError is an error that knows whether retrying could fix it
+type permanentError interface {
+	permanent() bool
+}
+
+// isPermanent looks through wrapped errors for one that knows whether it is permanent.  Errors
+// that do not know are assumed to be worth retrying.
+func isPermanent(err error) bool {
+	for err != nil {
+		if p, ok := err.(permanentError); ok {
+			return p.permanent()
+		}
+		w, ok := err.(*wrappedError)
+		if !ok {
+			return false
+		}
+		err = w.err
+	}
+	return false
+}
+
+// deadLetterSink is where messages go once they run out of attempts
+type deadLetterSink interface {
+	DeadLetter(ctx context.Context, m *message, reason error) error
+}
+
+// retryPolicy decides how long to hide a failed message before it is received again
+type retryPolicy struct {
+	maxAttempts int64
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+// validate rejects delays that would retry a failed message right away
+func (r *retryPolicy) validate() error {
+	if r.baseDelay < time.Second {
+		return fmt.Errorf("retry delay %s is under a second", r.baseDelay)
+	}
+	if r.maxDelay < r.baseDelay {
+		return fmt.Errorf("max retry delay %s is under the retry delay %s", r.maxDelay, r.baseDelay)
+	}
+	return nil
+}
+
+// backoff returns the visibility timeout, in seconds, to use after the given attempt failed
+func (r *retryPolicy) backoff(attempt int64) int64 {
+	delay := r.baseDelay
+	for i := int64(1); i < attempt && delay < r.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > r.maxDelay {
+		delay = r.maxDelay
+	}
+	// Round up, so a delay never becomes an immediate retry
+	ret := int64((delay + time.Second - 1) / time.Second)
+	if ret < 1 {
+		return 1
+	}
+	return ret
+}
+
+func (r *retryPolicy) exhausted(attempt int64) bool {
+	return r.maxAttempts > 0 && attempt >= r.maxAttempts
+}
+
+// retrier backs off or dead letters messages that failed to execute
+type retrier struct {
+	source          messageSource
+	policy          retryPolicy
+	deadLetters     deadLetterSink
+	msgToDeleteChan chan<- *message
+	inFlight        *inFlightMessages
+	log             logger
+}
+
+func (r *retrier) onFailure(ctx context.Context, f failedMessage) {
+	m := f.msg.OriginalMsg()
+	l := f.log
+	if l == nil {
+		l = withLogFields(r.log, messageLogFields(f.msg))
+	}
+	permanent := isPermanent(f.err)
+	if !permanent && !r.policy.exhausted(m.ReceiveCount) {
+		delay := r.policy.backoff(m.ReceiveCount)
+		warnf(l, "Message %s failed attempt %d.  Retrying in %d seconds", m.ID, m.ReceiveCount, delay)
+		// The source redelivers it after the delay.  Stop tracking it first, so the visibility
+		// heartbeat cannot undo the backoff.
+		r.inFlight.remove(m)
+		logIfErr(l, r.source.ChangeVisibility(ctx, m, delay), "cannot back off message %s", m.ID)
+		return
+	}
+	if permanent {
+		warnf(l, "Message %s failed with an error retrying will not fix: %s", m.ID, f.err.Error())
+	}
+	if r.deadLetters == nil {
+		warnf(l, "Message %s failed %d times and there is no dead letter queue.  Dropping it: %s", m.ID, m.ReceiveCount, m.String())
+	} else {
+		if err := r.deadLetters.DeadLetter(ctx, m, f.err); err != nil {
+			// Leave the message on the queue so it is not lost
+			logIfErr(l, err, "cannot dead letter message %s", m.ID)
+			r.inFlight.remove(m)
+			return
+		}
+		l.Printf("Message %s failed %d times.  Moved it to the dead letter queue", m.ID, m.ReceiveCount)
+	}
+	select {
+	case r.msgToDeleteChan <- m:
+	case <-ctx.Done():
+	}
+}
+
+func (r *retrier) processFailures(ctx context.Context, failures <-chan failedMessage) {
+	for f := range failures {
+		r.onFailure(ctx, f)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type recordingDeadLetter struct {
+	msgs []*message
+}
+
+func (r *recordingDeadLetter) DeadLetter(ctx context.Context, m *message, reason error) error {
+	r.msgs = append(r.msgs, m)
+	return nil
+}
+
+type failingMsg struct {
+	msg *message
+}
+
+func (f *failingMsg) LooksValid() bool              { return true }
+func (f *failingMsg) Execute(context.Context) error { return errors.New("nope") }
+func (f *failingMsg) OriginalMsg() *message         { return f.msg }
+func (f *failingMsg) SerializationKey() string      { return "" }
+
+func TestRetryBackoff(t *testing.T) {
+	r := retryPolicy{
+		maxAttempts: 5,
+		baseDelay:   time.Second * 30,
+		maxDelay:    time.Minute * 2,
+	}
+	assert.Equal(t, int64(30), r.backoff(1))
+	assert.Equal(t, int64(60), r.backoff(2))
+	assert.Equal(t, int64(120), r.backoff(3))
+	assert.Equal(t, int64(120), r.backoff(10))
+	assert.False(t, r.exhausted(4))
+	assert.True(t, r.exhausted(5))
+	assert.False(t, (&retryPolicy{}).exhausted(100))
+
+	// Partial and zero delays round up to a second rather than retrying right away
+	short := retryPolicy{baseDelay: time.Millisecond * 1500, maxDelay: time.Minute}
+	assert.Equal(t, int64(2), short.backoff(1))
+	assert.Equal(t, int64(1), (&retryPolicy{}).backoff(1))
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	assert.Nil(t, (&retryPolicy{baseDelay: time.Second, maxDelay: time.Minute}).validate())
+	assert.NotNil(t, (&retryPolicy{baseDelay: time.Millisecond * 500, maxDelay: time.Minute}).validate())
+	assert.NotNil(t, (&retryPolicy{baseDelay: time.Second * 30, maxDelay: 0}).validate())
+}
+
+func TestMemorySourceVisibilityTimeout(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	src := newMemorySource()
+	sent := src.Send("body")
+	msgs, err := src.Receive(ctx)
+	assert.Nil(t, err)
+
+	// A failed message comes back once its backoff runs out
+	assert.Nil(t, src.ChangeVisibility(ctx, msgs[0], 1))
+	receiveCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	msgs, err = src.Receive(receiveCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, []*message{sent}, msgs)
+	assert.Equal(t, int64(2), sent.ReceiveCount)
+
+	// Deleting a hidden message stops it from coming back
+	assert.Nil(t, src.ChangeVisibility(ctx, sent, 1))
+	assert.Nil(t, src.Delete(ctx, sent))
+	time.Sleep(time.Millisecond * 1100)
+	src.mu.Lock()
+	assert.Empty(t, src.pending)
+	src.mu.Unlock()
+}
+
+func TestRetrierDeadLetters(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	src := newMemorySource()
+	dl := &recordingDeadLetter{}
+	toDelete := make(chan *message, 1)
+	rt := retrier{
+		source:          src,
+		deadLetters:     dl,
+		msgToDeleteChan: toDelete,
+		log:             getLog(ctx),
+		policy: retryPolicy{
+			maxAttempts: 2,
+			baseDelay:   time.Second,
+			maxDelay:    time.Second,
+		},
+	}
+	sent := src.Send("body")
+
+	msgs, err := src.Receive(ctx)
+	assert.Nil(t, err)
+	rt.onFailure(ctx, failedMessage{msg: &failingMsg{msgs[0]}, err: errors.New("nope")})
+	assert.Equal(t, 0, len(dl.msgs))
+	assert.Equal(t, 0, len(toDelete))
+
+	assert.Nil(t, src.ChangeVisibility(ctx, sent, 0))
+	msgs, err = src.Receive(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), msgs[0].ReceiveCount)
+	rt.onFailure(ctx, failedMessage{msg: &failingMsg{msgs[0]}, err: errors.New("nope")})
+	assert.Equal(t, []*message{sent}, dl.msgs)
+	assert.Equal(t, sent, <-toDelete)
+}
+
+func TestRetrierPermanentFailure(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	src := newMemorySource()
+	dl := &recordingDeadLetter{}
+	toDelete := make(chan *message, 1)
+	rt := retrier{
+		source:          src,
+		deadLetters:     dl,
+		msgToDeleteChan: toDelete,
+		log:             getLog(ctx),
+		policy:          retryPolicy{maxAttempts: 5, baseDelay: time.Second, maxDelay: time.Second},
+	}
+	sent := src.Send("body")
+	msgs, err := src.Receive(ctx)
+	assert.Nil(t, err)
+
+	cerr := &conduitError{method: "harbormaster.sendmessage", code: "ERR-INVALID-AUTH", info: "bad token"}
+	rt.onFailure(ctx, failedMessage{msg: &failingMsg{msgs[0]}, err: wraperr(cerr, "cannot update harbormaster")})
+	assert.Equal(t, []*message{sent}, dl.msgs)
+	assert.Equal(t, sent, <-toDelete)
+}
+
+func TestIsPermanent(t *testing.T) {
+	assert.False(t, isPermanent(errors.New("nope")))
+	assert.False(t, isPermanent(nil))
+	assert.True(t, isPermanent(wraperr(&conduitError{code: "ERR-INVALID-AUTH"}, "outer")))
+	assert.True(t, isPermanent(&conduitError{code: "ERR-CONDUIT-CALL"}))
+	assert.False(t, isPermanent(&conduitError{code: "ERR-CONDUIT-CORE"}))
+	assert.False(t, isPermanent(wraperr(&conduitError{code: "ERR-SOMETHING-NEW"}, "outer")))
+	assert.False(t, isPermanent(&conduitError{statusCode: 502}))
+	assert.False(t, isPermanent(&conduitError{statusCode: 429}))
+	assert.True(t, isPermanent(&conduitError{statusCode: 404}))
+}
+
+func TestRetrierLogsMessageFields(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	src := newMemorySource()
+	dl := &recordingDeadLetter{}
+	buf := &bytes.Buffer{}
+	rt := retrier{
+		source:          src,
+		deadLetters:     dl,
+		msgToDeleteChan: make(chan *message, 2),
+		log:             newJSONLogger(buf, "buildtrigger", levelInfo),
+		policy:          retryPolicy{maxAttempts: 1, baseDelay: time.Second, maxDelay: time.Second},
+	}
+	src.Send("body")
+	msgs, err := src.Receive(ctx)
+	assert.Nil(t, err)
+
+	rt.onFailure(ctx, failedMessage{msg: &failingMsg{msgs[0]}, err: errors.New("nope")})
+	lines := decodeLogLines(t, buf)
+	assert.Equal(t, 1, len(lines))
+	for _, line := range lines {
+		assert.Equal(t, msgs[0].ID, line["msg_id"], line["msg"])
+	}
+
+	// The logger of the failed execution is used as is
+	buf.Reset()
+	l := newJSONLogger(buf, "buildtrigger", levelInfo).with(map[string]interface{}{"diff": 12})
+	rt.onFailure(ctx, failedMessage{msg: &failingMsg{msgs[0]}, err: errors.New("nope"), log: l})
+	lines = decodeLogLines(t, buf)
+	assert.Equal(t, 1, len(lines))
+	assert.Equal(t, float64(12), lines[0]["diff"])
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// inFlightMessages are the messages received but not yet deleted or handed back to the message
+// source.  A nil inFlightMessages tracks nothing.
+type inFlightMessages struct {
+	mu   sync.Mutex
+	msgs map[*message]struct{}
+}
+
+func newInFlightMessages() *inFlightMessages {
+	return &inFlightMessages{
+		msgs: make(map[*message]struct{}),
+	}
+}
+
+func (f *inFlightMessages) add(msgs ...*message) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, m := range msgs {
+		f.msgs[m] = struct{}{}
+	}
+}
+
+func (f *inFlightMessages) remove(m *message) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.msgs, m)
+}
+
+func (f *inFlightMessages) list() []*message {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := make([]*message, 0, len(f.msgs))
+	for m := range f.msgs {
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+// takeAll stops tracking every message and returns them
+func (f *inFlightMessages) takeAll() []*message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := make([]*message, 0, len(f.msgs))
+	for m := range f.msgs {
+		ret = append(ret, m)
+	}
+	f.msgs = make(map[*message]struct{})
+	return ret
+}
+
+// release makes every unfinished message receivable again right away, so another instance picks
+// it up instead of waiting out the visibility timeout
+func (f *inFlightMessages) release(ctx context.Context, source messageSource) {
+	l := getLog(ctx)
+	for _, m := range f.takeAll() {
+		if err := source.ChangeVisibility(ctx, m, 0); err != nil {
+			logIfErr(l, err, "cannot release unfinished message %s", m.ID)
+			continue
+		}
+		l.Printf("Released unfinished message %s", m.ID)
+	}
+}
+
+// tracks returns whether m is still in flight
+func (f *inFlightMessages) tracks(m *message) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, exists := f.msgs[m]
+	return exists
+}
+
+// extendTimeout bounds each visibility change the heartbeat makes
+const extendTimeout = time.Second * 10
+
+// extend hides every message still in flight for another timeout seconds.  The calls are made
+// without the lock, so a slow source does not hold up receiving and deleting.  A message removed
+// meanwhile may get one extra extension, which is harmless.
+func (f *inFlightMessages) extend(ctx context.Context, source messageSource, timeout int64) {
+	l := getLog(ctx)
+	for _, m := range f.list() {
+		if !f.tracks(m) {
+			continue
+		}
+		callCtx, cancel := context.WithTimeout(ctx, extendTimeout)
+		err := runCheck(callCtx, func(ctx context.Context) error {
+			return source.ChangeVisibility(ctx, m, timeout)
+		})
+		cancel()
+		logIfErr(l, err, "cannot extend visibility of message %s", m.ID)
+	}
+}
+
+// shutdown drains the bridge after a signal.  It stops receiving, gives messages already received
+// until the shutdown timeout to finish executing, deletes the ones that finished, and releases the
+// rest back to the message source.
+func (c *buildTrigger) shutdown(ctx context.Context, q *queuePoller, mp *msgProcessor, parsedMsgs chan parsedMessage, poolDone <-chan struct{}, inFlight *inFlightMessages, source messageSource) error {
+	l := getLog(ctx)
+	wr, isWebhooks := source.(*webhookReceiver)
+	if isWebhooks {
+		wr.startDraining()
+	}
+	q.stopReceiving()
+	if err := mp.Close(); err != nil {
+		return err
+	}
+	// Nothing sends parsed messages once the processor is closed
+	close(parsedMsgs)
+	// Every wait shares one deadline.  Its Done channel stays closed once it passes, so a wait that
+	// starts late returns right away instead of waiting without a limit.
+	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(c.shutdownTimeout))
+	defer cancel()
+	select {
+	case <-poolDone:
+		l.Printf("Every running message finished")
+	case <-deadline.Done():
+		warnf(l, "Messages still running after %s.  Releasing them", c.shutdownTimeout)
+	}
+	q.flushDeletes()
+	// A receive already in progress, like an SQS long poll, can still return messages.  Wait for
+	// it so they are released too.
+	select {
+	case <-q.Done():
+	case <-deadline.Done():
+		warnf(l, "Still receiving after %s.  Messages from that receive stay hidden until their visibility timeout", c.shutdownTimeout)
+	}
+	if isWebhooks {
+		// Webhooks only live in this process, so there is nobody to release them to
+		for _, m := range append(inFlight.takeAll(), wr.pendingMessages()...) {
+			warnf(l, "Webhook %s was not processed and is lost: %s", m.ID, m.String())
+		}
+		return nil
+	}
+	inFlight.release(ctx, source)
+	return nil
+}
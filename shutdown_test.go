@@ -0,0 +1,243 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// blockingMsg executes once release is closed, or immediately if it is nil
+type blockingMsg struct {
+	msg     *message
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingMsg) LooksValid() bool { return true }
+func (b *blockingMsg) Execute(context.Context) error {
+	if b.release != nil {
+		close(b.started)
+		<-b.release
+	}
+	return nil
+}
+func (b *blockingMsg) OriginalMsg() *message    { return b.msg }
+func (b *blockingMsg) SerializationKey() string { return "" }
+
+func TestInFlightMessages(t *testing.T) {
+	var nilTracker *inFlightMessages
+	nilTracker.add(&message{})
+	nilTracker.remove(&message{})
+	assert.Empty(t, nilTracker.list())
+
+	src := newMemorySource()
+	a := src.Send("a")
+	b := src.Send("b")
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	msgs, err := src.Receive(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, msgs, 2)
+
+	f := newInFlightMessages()
+	f.add(msgs...)
+	assert.Len(t, f.list(), 2)
+	assert.Nil(t, src.Delete(ctx, a))
+	f.remove(a)
+	assert.Equal(t, []*message{b}, f.list())
+
+	f.release(ctx, src)
+	assert.Empty(t, f.list())
+	msgs, err = src.Receive(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []*message{b}, msgs)
+}
+
+func TestShutdownReleasesUnfinished(t *testing.T) {
+	src := newMemorySource()
+	finished := src.Send("finished")
+	stuck := &blockingMsg{
+		msg:     src.Send("stuck"),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	defer close(stuck.release)
+	parse := func(m *message) (parsedMessage, error) {
+		if m == stuck.msg {
+			return stuck, nil
+		}
+		return &blockingMsg{msg: m}, nil
+	}
+
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	c := buildTrigger{workers: 2, shutdownTimeout: time.Millisecond * 50}
+	ch := make(chan *message)
+	parsedMsgs := make(chan parsedMessage)
+	msgToDeleteChan := make(chan *message)
+	inFlight := newInFlightMessages()
+	poolDone := make(chan struct{})
+	go func() {
+		assert.Nil(t, c.processParsedMessages(ctx, parsedMsgs, make(chan failedMessage), msgToDeleteChan))
+		close(poolDone)
+	}()
+	q := queuePoller{
+		source:          src,
+		inFlight:        inFlight,
+		msgInputChan:    ch,
+		msgToDeleteChan: msgToDeleteChan,
+	}
+	mp := newMsgProcessor(ch, make(chan *message), parsedMsgs, []msgConstructor{parse})
+	assert.Nil(t, q.Start(ctx))
+	assert.Nil(t, mp.Start(ctx))
+
+	waitForDeletes(t, src, 1)
+	<-stuck.started
+	assert.Nil(t, c.shutdown(ctx, &q, mp, parsedMsgs, poolDone, inFlight, src))
+
+	assert.Equal(t, []*message{finished}, src.Deleted())
+	assert.Empty(t, inFlight.list())
+	receiveCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	msgs, err := src.Receive(receiveCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, []*message{stuck.msg}, msgs)
+}
+
+func TestMainShutdownOnSignal(t *testing.T) {
+	src := newMemorySource()
+	signals := make(chan os.Signal, 1)
+	bt := buildTrigger{
+		apiToken:        "api-token",
+		circleToken:     "circle-token",
+		phaburl:         "http://127.0.0.1",
+		source:          src,
+		signals:         signals,
+		shutdownTimeout: time.Second,
+		retryDelay:      time.Second,
+		retryMaxDelay:   time.Minute,
+	}
+	mainErr := make(chan error)
+	go func() {
+		mainErr <- bt.main()
+	}()
+
+	valid := src.Send(exampleNonPhabCirclePost)
+	waitForDeletes(t, src, 1)
+	assert.Contains(t, src.Deleted(), valid)
+
+	signals <- syscall.SIGTERM
+	assert.Nil(t, <-mainErr)
+}
+
+// longPollSource ignores the context of Receive, like SQS, and returns once deliver is closed
+type longPollSource struct {
+	*memorySource
+	deliver chan struct{}
+}
+
+func (s *longPollSource) Receive(ctx context.Context) ([]*message, error) {
+	<-s.deliver
+	return s.memorySource.Receive(context.Background())
+}
+
+func TestShutdownWaitsForReceive(t *testing.T) {
+	src := &longPollSource{memorySource: newMemorySource(), deliver: make(chan struct{})}
+	late := src.Send("late")
+
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	c := buildTrigger{workers: 1, shutdownTimeout: time.Second * 5}
+	ch := make(chan *message)
+	parsedMsgs := make(chan parsedMessage)
+	msgToDeleteChan := make(chan *message)
+	inFlight := newInFlightMessages()
+	poolDone := make(chan struct{})
+	go func() {
+		assert.Nil(t, c.processParsedMessages(ctx, parsedMsgs, make(chan failedMessage), msgToDeleteChan))
+		close(poolDone)
+	}()
+	q := queuePoller{
+		source:          src,
+		inFlight:        inFlight,
+		msgInputChan:    ch,
+		msgToDeleteChan: msgToDeleteChan,
+	}
+	mp := newMsgProcessor(ch, make(chan *message), parsedMsgs, nil)
+	assert.Nil(t, q.Start(ctx))
+	assert.Nil(t, mp.Start(ctx))
+
+	shutdownErr := make(chan error)
+	go func() {
+		shutdownErr <- c.shutdown(ctx, &q, mp, parsedMsgs, poolDone, inFlight, src)
+	}()
+	// The long poll in progress returns a message after receiving stopped
+	time.Sleep(time.Millisecond * 100)
+	close(src.deliver)
+	assert.Nil(t, <-shutdownErr)
+
+	assert.Equal(t, []*message{late}, src.pendingMessages())
+	assert.Empty(t, inFlight.list())
+}
+
+// hangingSource returns its messages on the first Receive.  Later ones ignore the context, like
+// an SQS long poll, and only return once hang is closed.
+type hangingSource struct {
+	*memorySource
+	receives int32
+	hang     chan struct{}
+}
+
+func (s *hangingSource) Receive(ctx context.Context) ([]*message, error) {
+	if atomic.AddInt32(&s.receives, 1) == 1 {
+		return s.memorySource.Receive(ctx)
+	}
+	<-s.hang
+	return nil, nil
+}
+
+func TestShutdownTimeoutCoversReceive(t *testing.T) {
+	src := &hangingSource{memorySource: newMemorySource(), hang: make(chan struct{})}
+	defer close(src.hang)
+	stuck := &blockingMsg{
+		msg:     src.Send("stuck"),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	defer close(stuck.release)
+	parse := func(m *message) (parsedMessage, error) {
+		return stuck, nil
+	}
+
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	c := buildTrigger{workers: 1, shutdownTimeout: time.Millisecond * 100}
+	ch := make(chan *message)
+	parsedMsgs := make(chan parsedMessage)
+	msgToDeleteChan := make(chan *message)
+	inFlight := newInFlightMessages()
+	poolDone := make(chan struct{})
+	go func() {
+		assert.Nil(t, c.processParsedMessages(ctx, parsedMsgs, make(chan failedMessage), msgToDeleteChan))
+		close(poolDone)
+	}()
+	q := queuePoller{
+		source:          src,
+		inFlight:        inFlight,
+		msgInputChan:    ch,
+		msgToDeleteChan: msgToDeleteChan,
+	}
+	mp := newMsgProcessor(ch, make(chan *message), parsedMsgs, []msgConstructor{parse})
+	assert.Nil(t, q.Start(ctx))
+	assert.Nil(t, mp.Start(ctx))
+	<-stuck.started
+
+	// The worker outlives the timeout and so does the receive, yet shutdown takes one timeout
+	start := time.Now()
+	assert.Nil(t, c.shutdown(ctx, &q, mp, parsedMsgs, poolDone, inFlight, src))
+	assert.True(t, time.Since(start) < time.Second, "shutdown took %s", time.Since(start))
+	assert.Equal(t, []*message{stuck.msg}, src.pendingMessages())
+}
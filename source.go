@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// message is a transport neutral unit of work handed from a messageSource to the msgProcessor
+type message struct {
+	ID            string
+	Body          string
+	ReceiptHandle string
+	// ReceiveCount is how many times this message has been received, including this time
+	ReceiveCount int64
+}
+
+func (m *message) String() string {
+	return fmt.Sprintf("ID[%s] Body[%s]", m.ID, m.Body)
+}
+
+// messageSource is where the bridge receives its messages from.  SQS is the default implementation.
+type messageSource interface {
+	// Receive blocks until at least one message is ready, or returns an empty slice on a poll timeout
+	Receive(ctx context.Context) ([]*message, error)
+	// Delete acks a message so it is never redelivered
+	Delete(ctx context.Context, m *message) error
+	// ChangeVisibility hides a message from other receivers for timeout seconds
+	ChangeVisibility(ctx context.Context, m *message, timeout int64) error
+}
+
+var errMessageSourceClosed = errors.New("message source closed")
+
+// memorySource is an in process messageSource.  Messages sent to it are received in order.
+type memorySource struct {
+	mu       sync.Mutex
+	nextID   int64
+	pending  []*message
+	inFlight map[string]*message
+	deleted  []*message
+	// hidden has the timer that makes each hidden message receivable again
+	hidden map[string]*hideTimer
+
+	notify    chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ messageSource = &memorySource{}
+
+func newMemorySource() *memorySource {
+	return &memorySource{
+		inFlight: make(map[string]*message),
+		hidden:   make(map[string]*hideTimer),
+		notify:   make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Send queues body as a new message and returns it
+func (s *memorySource) Send(body string) *message {
+	s.mu.Lock()
+	s.nextID++
+	m := &message{
+		ID:   fmt.Sprintf("mem-%d", s.nextID),
+		Body: body,
+	}
+	m.ReceiptHandle = m.ID
+	s.pending = append(s.pending, m)
+	s.mu.Unlock()
+	s.wake()
+	return m
+}
+
+func (s *memorySource) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Close makes any current or future Receive return errMessageSourceClosed
+func (s *memorySource) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+// Deleted returns every message that has been deleted so far
+func (s *memorySource) Deleted() []*message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]*message, len(s.deleted))
+	copy(ret, s.deleted)
+	return ret
+}
+
+// pendingMessages returns the messages waiting to be received
+func (s *memorySource) pendingMessages() []*message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]*message, len(s.pending))
+	copy(ret, s.pending)
+	return ret
+}
+
+func (s *memorySource) Receive(ctx context.Context) ([]*message, error) {
+	for {
+		s.mu.Lock()
+		if len(s.pending) > 0 {
+			ret := s.pending
+			s.pending = nil
+			for _, m := range ret {
+				m.ReceiveCount++
+				s.inFlight[m.ReceiptHandle] = m
+			}
+			s.mu.Unlock()
+			return ret, nil
+		}
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.closed:
+			return nil, errMessageSourceClosed
+		case <-s.notify:
+		}
+	}
+}
+
+func (s *memorySource) Delete(ctx context.Context, m *message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.inFlight[m.ReceiptHandle]; !exists {
+		return fmt.Errorf("message %s is not in flight", m.ID)
+	}
+	s.stopTimer(m.ReceiptHandle)
+	delete(s.inFlight, m.ReceiptHandle)
+	s.deleted = append(s.deleted, m)
+	return nil
+}
+
+// ChangeVisibility makes the message receivable again after timeout seconds, or right away for
+// a zero timeout.  Messages received are in flight until deleted or given a timeout.
+func (s *memorySource) ChangeVisibility(ctx context.Context, m *message, timeout int64) error {
+	s.mu.Lock()
+	if _, exists := s.inFlight[m.ReceiptHandle]; !exists {
+		s.mu.Unlock()
+		return fmt.Errorf("message %s is not in flight", m.ID)
+	}
+	s.stopTimer(m.ReceiptHandle)
+	if timeout > 0 {
+		h := &hideTimer{}
+		h.timer = time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+			s.unhide(m, h)
+		})
+		s.hidden[m.ReceiptHandle] = h
+		s.mu.Unlock()
+		return nil
+	}
+	delete(s.inFlight, m.ReceiptHandle)
+	s.pending = append(s.pending, m)
+	s.mu.Unlock()
+	s.wake()
+	return nil
+}
+
+// hideTimer is the visibility timeout of one hidden message
+type hideTimer struct {
+	timer *time.Timer
+}
+
+// unhide makes a hidden message receivable once its visibility timeout runs out.  A timer that
+// was replaced or stopped after it fired does nothing.
+func (s *memorySource) unhide(m *message, h *hideTimer) {
+	s.mu.Lock()
+	if s.hidden[m.ReceiptHandle] != h {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.hidden, m.ReceiptHandle)
+	delete(s.inFlight, m.ReceiptHandle)
+	s.pending = append(s.pending, m)
+	s.mu.Unlock()
+	s.wake()
+}
+
+// stopTimer cancels a pending visibility timeout.  It is called with mu held.
+func (s *memorySource) stopTimer(receiptHandle string) {
+	if h, exists := s.hidden[receiptHandle]; exists {
+		h.timer.Stop()
+		delete(s.hidden, receiptHandle)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"golang.org/x/net/context"
+)
+
+// sqsSource is a messageSource backed by an SQS queue
+type sqsSource struct {
+	service           *sqs.SQS
+	queueURL          string
+	waitTimeSeconds   int64
+	visibilityTimeout int64
+	msgRemoveLog      logger
+}
+
+var _ messageSource = &sqsSource{}
+
+const receiveCountAttribute = "ApproximateReceiveCount"
+
+func fromSqsMessage(m *sqs.Message) *message {
+	ret := &message{}
+	if m.MessageId != nil {
+		ret.ID = *m.MessageId
+	}
+	if m.Body != nil {
+		ret.Body = *m.Body
+	}
+	if m.ReceiptHandle != nil {
+		ret.ReceiptHandle = *m.ReceiptHandle
+	}
+	if count, exists := m.Attributes[receiveCountAttribute]; exists && count != nil {
+		ret.ReceiveCount, _ = strconv.ParseInt(*count, 10, 64)
+	}
+	return ret
+}
+
+func (s *sqsSource) Receive(ctx context.Context) ([]*message, error) {
+	msg := sqs.ReceiveMessageInput{
+		QueueUrl:        &s.queueURL,
+		WaitTimeSeconds: &s.waitTimeSeconds,
+		AttributeNames:  []*string{aws.String(receiveCountAttribute)},
+	}
+	if s.visibilityTimeout != 0 {
+		msg.VisibilityTimeout = &s.visibilityTimeout
+	}
+	resp, err := s.service.ReceiveMessage(&msg)
+	if err != nil {
+		return nil, wraperr(err, "cannot receive messagges from queue")
+	}
+	ret := make([]*message, 0, len(resp.Messages))
+	for _, m := range resp.Messages {
+		ret = append(ret, fromSqsMessage(m))
+	}
+	return ret, nil
+}
+
+// queueVisibilityTimeout is the visibility timeout, in seconds, received messages get: the one
+// asked for, or else the queue's default
+func (s *sqsSource) queueVisibilityTimeout() (int64, error) {
+	if s.visibilityTimeout != 0 {
+		return s.visibilityTimeout, nil
+	}
+	input := sqs.GetQueueAttributesInput{
+		QueueUrl:       &s.queueURL,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameVisibilityTimeout)},
+	}
+	out, err := s.service.GetQueueAttributes(&input)
+	if err != nil {
+		return 0, wraperr(err, "cannot get visibility timeout of queue %s", s.queueURL)
+	}
+	timeout, exists := out.Attributes[sqs.QueueAttributeNameVisibilityTimeout]
+	if !exists || timeout == nil {
+		return 0, fmt.Errorf("queue %s has no visibility timeout", s.queueURL)
+	}
+	ret, err := strconv.ParseInt(*timeout, 10, 64)
+	if err != nil {
+		return 0, wraperr(err, "cannot parse visibility timeout %s", *timeout)
+	}
+	return ret, nil
+}
+
+func (s *sqsSource) Delete(ctx context.Context, m *message) error {
+	input := sqs.DeleteMessageInput{
+		QueueUrl:      &s.queueURL,
+		ReceiptHandle: &m.ReceiptHandle,
+	}
+	out, err := s.service.DeleteMessage(&input)
+	if err != nil {
+		return wraperr(err, "unable to delete a message")
+	}
+	s.msgRemoveLog.Printf("%s\n", out.GoString())
+	return nil
+}
+
+func (s *sqsSource) ChangeVisibility(ctx context.Context, m *message, timeout int64) error {
+	input := sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &s.queueURL,
+		ReceiptHandle:     &m.ReceiptHandle,
+		VisibilityTimeout: &timeout,
+	}
+	if _, err := s.service.ChangeMessageVisibility(&input); err != nil {
+		return wraperr(err, "unable to change visibility of message %s", m.ID)
+	}
+	return nil
+}
+
+// sqsDeadLetter forwards messages that ran out of attempts to another SQS queue
+type sqsDeadLetter struct {
+	service  *sqs.SQS
+	queueURL string
+	// secrets scrubs tokens out of the failure reason
+	secrets *redactor
+}
+
+var _ deadLetterSink = &sqsDeadLetter{}
+
+func (s *sqsDeadLetter) DeadLetter(ctx context.Context, m *message, reason error) error {
+	input := sqs.SendMessageInput{
+		QueueUrl:    &s.queueURL,
+		MessageBody: &m.Body,
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"FailureReason": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(s.secrets.redact(reason.Error())),
+			},
+			"OriginalMessageId": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(m.ID),
+			},
+		},
+	}
+	if _, err := s.service.SendMessage(&input); err != nil {
+		return wraperr(err, "unable to dead letter message %s", m.ID)
+	}
+	return nil
+}
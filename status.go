@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// readinessTimeout bounds each readiness check, so a hung dependency still gets an answer
+const readinessTimeout = time.Second * 5
+
+// readinessCheck is a dependency the bridge needs to do its work
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// statusServer serves the bridge's operational endpoints: /metrics, /healthz and /readyz
+type statusServer struct {
+	listener net.Listener
+	mux      *http.ServeMux
+	log      logger
+	checks   []readinessCheck
+	// secrets scrubs tokens out of check errors, since /readyz is not authenticated
+	secrets *redactor
+}
+
+func newStatusServer(l logger) *statusServer {
+	s := &statusServer{
+		mux: http.NewServeMux(),
+		log: l,
+	}
+	s.mux.Handle("/metrics", metrics.handler())
+	s.mux.HandleFunc("/healthz", s.healthz)
+	s.mux.HandleFunc("/readyz", s.readyz)
+	return s
+}
+
+// addCheck adds a dependency to /readyz
+func (s *statusServer) addCheck(name string, check func(ctx context.Context) error) {
+	s.checks = append(s.checks, readinessCheck{name: name, check: check})
+}
+
+func (s *statusServer) Handler() http.Handler {
+	return s.mux
+}
+
+// healthz answers as long as the process is serving
+func (s *statusServer) healthz(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.Write([]byte("ok\n"))
+}
+
+// readyz runs every readiness check at once and reports each result.  Any failure makes the
+// response a 503.
+func (s *statusServer) readyz(rw http.ResponseWriter, req *http.Request) {
+	results := make(map[string]string, len(s.checks))
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	wg.Add(len(s.checks))
+	for _, c := range s.checks {
+		go func(c readinessCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(setLog(context.Background(), s.log), readinessTimeout)
+			defer cancel()
+			result := "ok"
+			if err := runCheck(ctx, c.check); err != nil {
+				result = s.secrets.redact(err.Error())
+			}
+			mu.Lock()
+			results[c.name] = result
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	status := http.StatusOK
+	for name, result := range results {
+		if result != "ok" {
+			warnf(s.log, "Not ready: %s: %s", name, result)
+			status = http.StatusServiceUnavailable
+		}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	logIfErr(s.log, json.NewEncoder(rw).Encode(results), "cannot write readiness")
+}
+
+// runCheck returns the check's error, or the context's if the check takes too long
+func runCheck(ctx context.Context, check func(ctx context.Context) error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *statusServer) listen(addr string) error {
+	l, err := serveHTTP(addr, s.Handler())
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	return nil
+}
+
+func (s *statusServer) Close() error {
+	return closeListener(s.listener)
+}
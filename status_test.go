@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func getJSON(t *testing.T, url string) (int, map[string]string) {
+	resp, err := http.Get(url)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	var ret map[string]string
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&ret))
+	return resp.StatusCode, ret
+}
+
+func TestReadiness(t *testing.T) {
+	s := newStatusServer(log.New(ioutil.Discard, "", 0))
+	receives := &receiveStatus{}
+	s.addCheck("receive", receives.check)
+	s.addCheck("other", func(ctx context.Context) error { return nil })
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/healthz")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	code, results := getJSON(t, server.URL+"/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]string{"receive": "ok", "other": "ok"}, results)
+
+	receives.record(errors.New("access denied"))
+	code, results = getJSON(t, server.URL+"/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "last receive failed: access denied", results["receive"])
+	assert.Equal(t, "ok", results["other"])
+
+	receives.record(nil)
+	code, _ = getJSON(t, server.URL+"/readyz")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestDependencyChecks(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	p, server, calls := newTestConduit(t, `{"result": "pong", "error_code": null, "error_info": null}`)
+	defer server.Close()
+	assert.Nil(t, p.ping(ctx))
+	assert.Equal(t, "api-token", calls["/api/conduit.ping"].Get("api.token"))
+
+	circle := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/me" || req.Header.Get("Circle-Token") != "good" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rw.Write([]byte(`{"login": "bot"}`))
+	}))
+	defer circle.Close()
+	assert.Nil(t, (&circleClient{token: "good", baseURL: circle.URL}).me(ctx))
+	assert.NotNil(t, (&circleClient{token: "bad", baseURL: circle.URL}).me(ctx))
+
+	dir, err := ioutil.TempDir("", "writable")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, (&githubPusher{tmpDir: dir}).checkWritable(ctx))
+	assert.NotNil(t, (&githubPusher{tmpDir: "/does/not/exist"}).checkWritable(ctx))
+}
+
+func TestReadinessRedactsSecrets(t *testing.T) {
+	s := newStatusServer(log.New(ioutil.Discard, "", 0))
+	s.secrets = newRedactor("api-token")
+	s.addCheck("conduit", func(ctx context.Context) error {
+		return errors.New("cannot call https://phab/api/conduit.ping?api.token=api-token")
+	})
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+
+	_, results := getJSON(t, server.URL+"/readyz")
+	assert.Equal(t, "cannot call https://phab/api/conduit.ping?api.token=[REDACTED]", results["conduit"])
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// watchdogInterval is how often the watchdog looks for overdue builds
+const watchdogInterval = time.Minute
+
+// buildWatchdog publishes builds whose result message never arrived.  Builds that finished are
+// published as if CircleCI had reported them.  Builds still running after the timeout are
+// canceled and their build target failed.  With a zero timeout builds never time out.  It also
+// marks the build targets of queued builds working once their builds run.
+type buildWatchdog struct {
+	builds  *buildTracker
+	ci      *ciRegistry
+	results circleManager
+	timeout time.Duration
+}
+
+func (w *buildWatchdog) run(ctx context.Context) {
+	t := time.NewTicker(watchdogInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			w.check(ctx)
+		}
+	}
+}
+
+func (w *buildWatchdog) check(ctx context.Context) {
+	for _, b := range w.builds.queued() {
+		w.checkStarted(ctx, b)
+	}
+	if w.timeout <= 0 {
+		return
+	}
+	for _, b := range w.builds.overdue(w.timeout) {
+		w.checkBuild(ctx, b)
+	}
+}
+
+func (w *buildWatchdog) checkBuild(ctx context.Context, b buildRecord) {
+	l := getLog(ctx)
+	ci, err := w.ci.forCallsign(b.Callsign)
+	if err != nil {
+		logIfErr(l, err, "cannot check overdue build %s", b.BuildURL)
+		return
+	}
+	msg := w.resultsMsg(ci, b)
+	l = withLogFields(l, msg.logFields())
+	ctx = setLog(ctx, l)
+	status, err := ci.buildStatus(ctx, b.Username, b.Project, b.BuildNum)
+	if err == nil && status.finished() {
+		l.Printf("Build %s finished without reporting back.  Publishing its result", b.BuildURL)
+		msg.FormParams.Payload.Outcome = status.Outcome
+		logIfErr(l, msg.publishResults(ctx), "cannot publish overdue build %s", b.BuildURL)
+		return
+	}
+	if err != nil {
+		logIfErr(l, err, "cannot get status of overdue build %s", b.BuildURL)
+		// Give CircleCI a while to come back before giving up on the build
+		if w.builds.age(b) < w.timeout*2 {
+			return
+		}
+	}
+	w.timeoutBuild(ctx, ci, msg, b)
+}
+
+// checkStarted marks the build target of a queued build working once the build runs.  A build
+// that finished first goes straight to its result.
+func (w *buildWatchdog) checkStarted(ctx context.Context, b buildRecord) {
+	l := getLog(ctx)
+	ci, err := w.ci.forCallsign(b.Callsign)
+	if err != nil {
+		logIfErr(l, err, "cannot check queued build %s", b.BuildURL)
+		return
+	}
+	status, err := ci.buildStatus(ctx, b.Username, b.Project, b.BuildNum)
+	if err != nil {
+		logIfErr(l, err, "cannot get status of queued build %s", b.BuildURL)
+		return
+	}
+	if !status.running() {
+		return
+	}
+	if err := w.results.phab.updateHarbormaster(ctx, b.TargetPHID, harbormasterWork, nil, nil); err != nil {
+		// The build stays queued, so the next check tries again
+		logIfErr(l, err, "cannot mark %s as building", b.TargetPHID)
+		return
+	}
+	w.builds.markRunning(ctx, b.TargetPHID)
+}
+
+// resultsMsg is the message CircleCI would have sent when the build finished
+func (w *buildWatchdog) resultsMsg(ci ciProvider, b buildRecord) *circleCiMsg {
+	return &circleCiMsg{
+		FormParams: circleMsg{
+			Payload: circleCiPayload{
+				BuildURL: b.BuildURL,
+				Branch:   fmt.Sprintf("phabricator_test_%s", b.Callsign),
+				Username: b.Username,
+				Reponame: b.Project,
+				BuildNum: b.BuildNum,
+				BuildParameters: map[string]string{
+					"diff":        strconv.Itoa(b.Diff),
+					"revision":    strconv.Itoa(b.Revision),
+					"phid":        b.TargetPHID,
+					"staging_ref": b.StagingRef,
+					"staging_uri": b.StagingURI,
+					"callsign":    b.Callsign,
+				},
+			},
+		},
+		parent:   &w.results,
+		provider: ci,
+	}
+}
+
+// timeoutBuild cancels a build that ran too long, fails its build target and cleans up after it
+func (w *buildWatchdog) timeoutBuild(ctx context.Context, ci ciProvider, msg *circleCiMsg, b buildRecord) {
+	l := getLog(ctx)
+	l.Printf("Build %s timed out", b.BuildURL)
+	superseded, finishedBefore := w.builds.published(b.TargetPHID)
+	if finishedBefore {
+		return
+	}
+	logIfErr(l, ci.cancelBuild(ctx, b.Username, b.Project, b.BuildNum), "cannot cancel timed out build %d", b.BuildNum)
+	if !superseded {
+		units := []harbormasterUnitResult{
+			{
+				Name:    "Timeout",
+				Result:  unitFail,
+				Details: fmt.Sprintf("CircleCI did not report the result of %s within %s", b.BuildURL, w.timeout),
+			},
+		}
+		if err := w.results.phab.updateHarbormaster(ctx, b.TargetPHID, harbormasterFail, units, nil); err != nil {
+			// The build stays overdue, so the next check tries again
+			logIfErr(l, err, "cannot fail timed out target %s", b.TargetPHID)
+			return
+		}
+	}
+	w.builds.markFinished(ctx, b.TargetPHID, "timedout")
+	repoDir, err := cloneDir(b.StagingURI)
+	if err != nil {
+		logIfErr(l, err, "cannot clean up after timed out build %s", b.BuildURL)
+		return
+	}
+	msg.cleanup(ctx, b.StagingURI, repoDir, int64(b.Diff))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func newTestWatchdog(t *testing.T, status *buildStatus) (*buildWatchdog, *fakeCI, map[string]url.Values, func()) {
+	tmpDir, err := ioutil.TempDir("", "watchdog")
+	assert.Nil(t, err)
+	// An existing clone keeps cleanup from reaching for the network
+	assert.Nil(t, os.Mkdir(filepath.Join(tmpDir, "arepo"), 0700))
+	phab, server, calls := newTestConduit(t, `{"result": {}, "error_code": null, "error_info": null}`)
+	ci := &fakeCI{status: status}
+	configs := &repoConfigs{}
+	builds := newBuildTracker()
+	w := &buildWatchdog{
+		builds: builds,
+		ci: &ciRegistry{
+			configs:   configs,
+			providers: map[string]ciProvider{defaultCIProvider: ci},
+		},
+		results: circleManager{
+			git:     &githubPusher{phab: phab, tmpDir: tmpDir},
+			phab:    phab,
+			configs: configs,
+			builds:  builds,
+		},
+		timeout: time.Hour,
+	}
+	builds.start(setLog(context.Background(), log.New(ioutil.Discard, "", 0)), trackedBuild{
+		TargetPHID: "PHID-HMBT-1",
+		Diff:       10,
+		Revision:   5,
+		Callsign:   "ABC",
+		Username:   "signalfx",
+		Project:    "arepo",
+		BuildNum:   7,
+		BuildURL:   "https://circleci.com/gh/signalfx/arepo/7",
+		StagingRef: "refs/tags/phabricator/diff/10",
+		StagingURI: "git@github.com:signalfx/arepo.git",
+	})
+	return w, ci, calls, func() {
+		server.Close()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestWatchdogWaitsForTimeout(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	w, ci, _, done := newTestWatchdog(t, &buildStatus{Lifecycle: "running"})
+	defer done()
+	w.check(ctx)
+	assert.Nil(t, ci.canceled)
+	r, _ := w.builds.get("PHID-HMBT-1")
+	assert.Nil(t, r.Finished)
+}
+
+func TestWatchdogPublishesFinishedBuild(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	w, ci, calls, done := newTestWatchdog(t, &buildStatus{Lifecycle: "finished", Outcome: "failed"})
+	defer done()
+	w.builds.now = func() time.Time { return time.Now().Add(time.Hour * 2) }
+	w.check(ctx)
+
+	assert.Nil(t, ci.canceled)
+	form := calls["/api/harbormaster.sendmessage"]
+	assert.Equal(t, "PHID-HMBT-1", form.Get("buildTargetPHID"))
+	assert.Equal(t, string(harbormasterFail), form.Get("type"))
+	r, _ := w.builds.get("PHID-HMBT-1")
+	assert.Equal(t, "failed", r.Outcome)
+}
+
+func TestWatchdogTimesOutRunningBuild(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	w, ci, calls, done := newTestWatchdog(t, &buildStatus{Lifecycle: "running"})
+	defer done()
+	w.builds.now = func() time.Time { return time.Now().Add(time.Hour * 2) }
+	w.check(ctx)
+
+	assert.Equal(t, []int{7}, ci.canceled)
+	form := calls["/api/harbormaster.sendmessage"]
+	assert.Equal(t, string(harbormasterFail), form.Get("type"))
+	var units []harbormasterUnitResult
+	assert.Nil(t, json.Unmarshal([]byte(form.Get("unit")), &units))
+	assert.Equal(t, "Timeout", units[0].Name)
+	r, _ := w.builds.get("PHID-HMBT-1")
+	assert.Equal(t, "timedout", r.Outcome)
+
+	// Once published, the build is not looked at again
+	w.check(ctx)
+	assert.Equal(t, []int{7}, ci.canceled)
+}
+
+func TestWatchdogRetriesUnpublishedResults(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	for _, status := range []*buildStatus{{Lifecycle: "finished", Outcome: "success"}, {Lifecycle: "running"}} {
+		w, _, _, done := newTestWatchdog(t, status)
+		failing, server, _ := newTestConduit(t, `{"result": null, "error_code": "ERR-CONDUIT-CORE", "error_info": "deadlock"}`)
+		w.results.phab = failing
+		w.builds.now = func() time.Time { return time.Now().Add(time.Hour * 2) }
+		w.check(ctx)
+
+		// Harbormaster never got the result, so the build is still waiting on one
+		_, finishedBefore := w.builds.published("PHID-HMBT-1")
+		assert.False(t, finishedBefore, status.Lifecycle)
+		assert.Len(t, w.builds.overdue(time.Hour), 1)
+		server.Close()
+		done()
+	}
+}
+
+func TestPublishCleansUpAfterFailedComment(t *testing.T) {
+	buf := &bytes.Buffer{}
+	ctx := setLog(context.Background(), log.New(buf, "", 0))
+	w, _, _, done := newTestWatchdog(t, &buildStatus{Lifecycle: "finished", Outcome: "success"})
+	defer done()
+	phab, server, calls := newRoutedConduit(t, map[string]string{
+		"":                                `{"result": {}, "error_code": null, "error_info": null}`,
+		"/api/conduit.query":              `{"result": {}, "error_code": null, "error_info": null}`,
+		"/api/differential.createcomment": `{"result": null, "error_code": "ERR-CONDUIT-CORE", "error_info": "deadlock"}`,
+	})
+	defer server.Close()
+	w.results.phab = phab
+	w.builds.now = func() time.Time { return time.Now().Add(time.Hour * 2) }
+	w.check(ctx)
+
+	// The result reached Harbormaster, so the build is done even though the comment failed, and
+	// its staging branch and tag are still cleaned up
+	assert.Equal(t, string(harbormasterPass), calls["/api/harbormaster.sendmessage"].Get("type"))
+	_, finished := w.builds.published("PHID-HMBT-1")
+	assert.True(t, finished)
+	assert.Contains(t, buf.String(), "cannot post result comment")
+	assert.Contains(t, buf.String(), "Cannot remove branch 10")
+}
+
+func TestWatchdogMarksQueuedBuildRunning(t *testing.T) {
+	ctx := setLog(context.Background(), log.New(ioutil.Discard, "", 0))
+	w, ci, calls, done := newTestWatchdog(t, &buildStatus{Lifecycle: "queued"})
+	defer done()
+	// Builds that never time out are still moved to running
+	w.timeout = 0
+	w.builds.start(ctx, trackedBuild{TargetPHID: "PHID-HMBT-2", Diff: 11, Revision: 6, Callsign: "ABC", BuildNum: 8, Queued: true})
+
+	w.check(ctx)
+	assert.Nil(t, calls["/api/harbormaster.sendmessage"])
+	assert.Len(t, w.builds.queued(), 1)
+
+	ci.status = &buildStatus{Lifecycle: "running"}
+	w.check(ctx)
+	form := calls["/api/harbormaster.sendmessage"]
+	assert.Equal(t, "PHID-HMBT-2", form.Get("buildTargetPHID"))
+	assert.Equal(t, string(harbormasterWork), form.Get("type"))
+	assert.Len(t, w.builds.queued(), 0)
+	r, _ := w.builds.get("PHID-HMBT-2")
+	assert.Nil(t, r.Finished)
+	assert.Nil(t, ci.canceled)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	harbormasterWebhookPath = "/harbormaster"
+	circleciWebhookPath     = "/circleci"
+)
+
+// webhookReceiver is a messageSource that accepts Harbormaster and CircleCI webhooks directly.  It
+// wraps each request in the same envelope the API gateway mapping template creates, so the
+// existing message parsers do not know the difference.
+type webhookReceiver struct {
+	*memorySource
+	listener net.Listener
+	log      logger
+	// secret authenticates every webhook
+	secret string
+
+	mu       sync.Mutex
+	draining bool
+}
+
+var _ messageSource = &webhookReceiver{}
+
+func newWebhookReceiver(l logger, secret string) *webhookReceiver {
+	return &webhookReceiver{
+		memorySource: newMemorySource(),
+		log:          l,
+		secret:       secret,
+	}
+}
+
+// webhookEnvelope mirrors the API gateway mapping template documented in the README
+type webhookEnvelope struct {
+	FormParams    json.RawMessage              `json:"formparams"`
+	AllParamsJSON map[string]map[string]string `json:"allParamsJson"`
+}
+
+func (w *webhookReceiver) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(harbormasterWebhookPath, w.ServeHTTP)
+	mux.HandleFunc(circleciWebhookPath, w.ServeHTTP)
+	return mux
+}
+
+func (w *webhookReceiver) listen(addr string) error {
+	l, err := serveHTTP(addr, w.Handler())
+	if err != nil {
+		return err
+	}
+	w.listener = l
+	return nil
+}
+
+// startDraining makes new webhooks fail with a 503, so senders retry them against another instance
+// instead of having them lost when the process exits
+func (w *webhookReceiver) startDraining() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.draining = true
+}
+
+// queue sends body to the memory source unless draining has started.  Holding mu means no
+// webhook is queued once startDraining returns.
+func (w *webhookReceiver) queue(body string) (*message, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.draining {
+		return nil, false
+	}
+	return w.Send(body), true
+}
+
+// Close stops accepting webhooks
+func (w *webhookReceiver) Close() error {
+	err := closeListener(w.listener)
+	logIfErr(w.log, w.memorySource.Close(), "cannot close memory source")
+	return err
+}
+
+func singleValues(vals map[string][]string) map[string]string {
+	ret := make(map[string]string, len(vals))
+	for k, v := range vals {
+		if len(v) > 0 {
+			ret[k] = v[0]
+		}
+	}
+	return ret
+}
+
+// maxWebhookBytes caps the size of a webhook body
+const maxWebhookBytes = 1 << 20
+
+// errEmptyWebhook is a webhook with no body where one is needed
+var errEmptyWebhook = errors.New("webhook has no body")
+
+// readBody reads the whole request body, up to maxWebhookBytes
+func readBody(req *http.Request) ([]byte, error) {
+	body := bytes.Buffer{}
+	if req.Body != nil {
+		if _, err := io.Copy(&body, io.LimitReader(req.Body, maxWebhookBytes)); err != nil {
+			return nil, wraperr(err, "cannot read request body")
+		}
+	}
+	return body.Bytes(), nil
+}
+
+// formParams converts a JSON or form encoded body to JSON.  Harbormaster sends its parameters in
+// the query string with no body, so only that path may have an empty body.
+func formParams(req *http.Request, body []byte) (json.RawMessage, error) {
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		vals, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, wraperr(err, "cannot parse form body")
+		}
+		return json.Marshal(singleValues(vals))
+	}
+	if len(body) == 0 {
+		if req.URL.Path == harbormasterWebhookPath {
+			return json.RawMessage("{}"), nil
+		}
+		return nil, errEmptyWebhook
+	}
+	if !json.Valid(body) {
+		return nil, errors.New("webhook body is not JSON")
+	}
+	return json.RawMessage(body), nil
+}
+
+func (w *webhookReceiver) envelope(req *http.Request, body []byte) ([]byte, error) {
+	fp, err := formParams(req, body)
+	if err != nil {
+		return nil, err
+	}
+	// The secret and signatures made with it are not part of the message, which can end up on
+	// the dead letter queue
+	query := req.URL.Query()
+	query.Del(webhookTokenParam)
+	header := singleValues(req.Header)
+	delete(header, http.CanonicalHeaderKey(webhookTokenHeader))
+	delete(header, http.CanonicalHeaderKey(circleSignatureHeader))
+	env := webhookEnvelope{
+		FormParams: fp,
+		AllParamsJSON: map[string]map[string]string{
+			"header":      header,
+			"path":        {},
+			"querystring": singleValues(query),
+		},
+	}
+	return json.Marshal(&env)
+}
+
+const (
+	// webhookTokenParam and webhookTokenHeader carry the shared secret for senders, like
+	// Harbormaster, that cannot sign requests
+	webhookTokenParam  = "token"
+	webhookTokenHeader = "X-Webhook-Token"
+	// circleSignatureHeader is how CircleCI signs webhooks: v1=<hex HMAC-SHA256 of the body>
+	circleSignatureHeader = "Circleci-Signature"
+)
+
+// authenticated checks the request carries the shared secret, either as a token or as a CircleCI
+// webhook signature made with it
+func (w *webhookReceiver) authenticated(req *http.Request, body []byte) bool {
+	if w.secret == "" {
+		return false
+	}
+	for _, token := range []string{req.URL.Query().Get(webhookTokenParam), req.Header.Get(webhookTokenHeader)} {
+		if token != "" && hmac.Equal([]byte(token), []byte(w.secret)) {
+			return true
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(w.secret))
+	mac.Write(body)
+	expected := "v1=" + hex.EncodeToString(mac.Sum(nil))
+	for _, sig := range strings.Split(req.Header.Get(circleSignatureHeader), ",") {
+		if hmac.Equal([]byte(strings.TrimSpace(sig)), []byte(expected)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *webhookReceiver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := readBody(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !w.authenticated(req, body) {
+		warnf(w.log, "Rejected unauthenticated webhook to %s", req.URL.Path)
+		http.Error(rw, "missing or invalid webhook token", http.StatusUnauthorized)
+		return
+	}
+	env, err := w.envelope(req, body)
+	if err != nil {
+		warnf(w.log, "Rejected webhook to %s: %s", req.URL.Path, err.Error())
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, queued := w.queue(string(env))
+	if !queued {
+		http.Error(rw, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	w.log.Printf("Webhook %s queued as %s", req.URL.Path, m.ID)
+	rw.Header().Set("Content-Type", "application/json")
+	logIfErr(w.log, json.NewEncoder(rw).Encode(map[string]string{"id": m.ID}), "cannot write response")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestWebhookHarbormaster(t *testing.T) {
+	w := newWebhookReceiver(log.New(ioutil.Discard, "", 0), "s3cret")
+	req, err := http.NewRequest("POST", "/harbormaster?phid=PHID-HMBT-abc&diff=12&revision=34&staging_uri=git@github.com:signalfx/repo.git&token=s3cret", nil)
+	assert.Nil(t, err)
+	rw := httptest.NewRecorder()
+	w.Handler().ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	msgs, err := w.Receive(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msgs))
+
+	hp := harbormasterPublisher{}
+	parsed, err := hp.parseHarbormasterMsg(msgs[0])
+	assert.Nil(t, err)
+	hm := parsed.(*harbormasterMessage)
+	assert.Equal(t, 12, hm.getDiffID())
+	assert.Equal(t, 34, hm.getRevID())
+	_, hasToken := hm.AllParamTypes["querystring"]["token"]
+	assert.False(t, hasToken)
+}
+
+func TestWebhookCircleCI(t *testing.T) {
+	w := newWebhookReceiver(log.New(ioutil.Discard, "", 0), "s3cret")
+	req, err := http.NewRequest("POST", "/circleci", strings.NewReader(`{"payload": {"branch": "phabricator_test_X", "build_url": "https://circleci.com/gh/signalfx/repo/1", "reponame": "repo", "vcs_url": "https://github.com/signalfx/repo", "build_parameters": {"phid": "PHID-HMBT-abc"}}}`))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Token", "s3cret")
+	rw := httptest.NewRecorder()
+	w.Handler().ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	msgs, err := w.Receive(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msgs))
+
+	cm := circleManager{}
+	parsed, err := cm.parseCircleCImsg(msgs[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "PHID-HMBT-abc", parsed.(*circleCiMsg).FormParams.Payload.BuildParameters["phid"])
+}
+
+func TestWebhookRejectsGet(t *testing.T) {
+	w := newWebhookReceiver(log.New(ioutil.Discard, "", 0), "s3cret")
+	req, err := http.NewRequest("GET", "/circleci", nil)
+	assert.Nil(t, err)
+	rw := httptest.NewRecorder()
+	w.Handler().ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+}
+
+func TestWebhookRejectsWhileDraining(t *testing.T) {
+	w := newWebhookReceiver(log.New(ioutil.Discard, "", 0), "s3cret")
+	w.startDraining()
+	req, err := http.NewRequest("POST", "/circleci?token=s3cret", strings.NewReader(`{"payload": {}}`))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	rw := httptest.NewRecorder()
+	w.Handler().ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Empty(t, w.pendingMessages())
+}
+
+func TestWebhookRejectsMalformed(t *testing.T) {
+	w := newWebhookReceiver(log.New(ioutil.Discard, "", 0), "s3cret")
+	for _, body := range []string{"", "not json", `{"truncated": `} {
+		req, err := http.NewRequest("POST", "/circleci?token=s3cret", strings.NewReader(body))
+		assert.Nil(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		rw := httptest.NewRecorder()
+		w.Handler().ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusBadRequest, rw.Code, body)
+	}
+	assert.Empty(t, w.pendingMessages())
+}
+
+func TestWebhookAuthentication(t *testing.T) {
+	body := `{"type": "workflow-completed"}`
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(body))
+	signature := "v1=" + hex.EncodeToString(mac.Sum(nil))
+
+	for name, tc := range map[string]struct {
+		secret string
+		path   string
+		header map[string]string
+		code   int
+	}{
+		"query token":      {"s3cret", "/circleci?token=s3cret", nil, http.StatusOK},
+		"header token":     {"s3cret", "/circleci", map[string]string{"X-Webhook-Token": "s3cret"}, http.StatusOK},
+		"circle signature": {"s3cret", "/circleci", map[string]string{"Circleci-Signature": "v1=abc, " + signature}, http.StatusOK},
+		"no token":         {"s3cret", "/circleci", nil, http.StatusUnauthorized},
+		"wrong token":      {"s3cret", "/circleci?token=guess", nil, http.StatusUnauthorized},
+		"bad signature":    {"s3cret", "/circleci", map[string]string{"Circleci-Signature": "v1=abc"}, http.StatusUnauthorized},
+		"no secret":        {"", "/circleci?token=", nil, http.StatusUnauthorized},
+	} {
+		w := newWebhookReceiver(log.New(ioutil.Discard, "", 0), tc.secret)
+		req, err := http.NewRequest("POST", tc.path, strings.NewReader(body))
+		assert.Nil(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		rw := httptest.NewRecorder()
+		w.Handler().ServeHTTP(rw, req)
+		assert.Equal(t, tc.code, rw.Code, name)
+		if tc.code != http.StatusOK {
+			continue
+		}
+		// The queued message never carries the secret or a signature made with it
+		msgs := w.pendingMessages()
+		assert.Len(t, msgs, 1, name)
+		assert.NotContains(t, msgs[0].Body, "s3cret", name)
+		assert.NotContains(t, msgs[0].Body, signature, name)
+		assert.Contains(t, msgs[0].Body, "Content-Type", name)
+	}
+}
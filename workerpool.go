@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// workerPool executes parsed messages on at most workers goroutines.  Messages that share a
+// SerializationKey run one at a time, in the order they arrived.  Messages with an empty key are
+// never serialized.  At most workers messages wait behind a running key; once that many wait,
+// dispatching blocks, so the poller stops taking messages instead of queuing them without bound.
+type workerPool struct {
+	workers int
+	handle  func(context.Context, parsedMessage)
+
+	mu sync.Mutex
+	// waiting holds the messages queued behind a running message for the same key.  A key is
+	// present, even with an empty slice, while a message for it is running.
+	waiting map[string][]parsedMessage
+	// queued counts the messages in waiting.  changed is signalled when a message leaves waiting
+	// or a key is released.
+	queued  int
+	changed *sync.Cond
+	slots   chan struct{}
+	running sync.WaitGroup
+}
+
+func newWorkerPool(workers int, handle func(context.Context, parsedMessage)) *workerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	w := &workerPool{
+		workers: workers,
+		handle:  handle,
+		waiting: make(map[string][]parsedMessage),
+		slots:   make(chan struct{}, workers),
+	}
+	w.changed = sync.NewCond(&w.mu)
+	return w
+}
+
+// run executes every message from msgs and returns once msgs is closed and all work is done
+func (w *workerPool) run(ctx context.Context, msgs <-chan parsedMessage) {
+	for m := range msgs {
+		w.dispatch(ctx, m)
+	}
+	w.running.Wait()
+}
+
+func (w *workerPool) dispatch(ctx context.Context, m parsedMessage) {
+	key := m.SerializationKey()
+	if key != "" && w.enqueue(key, m) {
+		return
+	}
+	w.slots <- struct{}{}
+	w.running.Add(1)
+	go w.work(ctx, key, m)
+}
+
+// enqueue queues m behind the running message for key and returns true, waiting for room if
+// too many messages are queued already.  If nothing runs for key, it claims key and returns false.
+func (w *workerPool) enqueue(key string, m parsedMessage) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for {
+		queue, busy := w.waiting[key]
+		if !busy {
+			w.waiting[key] = nil
+			return false
+		}
+		if w.queued < w.workers {
+			w.waiting[key] = append(queue, m)
+			w.queued++
+			return true
+		}
+		w.changed.Wait()
+	}
+}
+
+func (w *workerPool) work(ctx context.Context, key string, m parsedMessage) {
+	defer func() {
+		<-w.slots
+		w.running.Done()
+	}()
+	for m != nil {
+		w.handle(ctx, m)
+		m = w.next(key)
+	}
+}
+
+// next pops the next message waiting on key, releasing the key if there are none
+func (w *workerPool) next(key string) parsedMessage {
+	if key == "" {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer w.changed.Broadcast()
+	queue := w.waiting[key]
+	if len(queue) == 0 {
+		delete(w.waiting, key)
+		return nil
+	}
+	w.waiting[key] = queue[1:]
+	w.queued--
+	return queue[0]
+}
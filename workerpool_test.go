@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type keyedMsg struct {
+	key  string
+	name string
+}
+
+func (k *keyedMsg) LooksValid() bool              { return true }
+func (k *keyedMsg) Execute(context.Context) error { return nil }
+func (k *keyedMsg) OriginalMsg() *message         { return &message{ID: k.name} }
+func (k *keyedMsg) SerializationKey() string      { return k.key }
+
+func TestWorkerPoolSerializesPerKey(t *testing.T) {
+	var mu sync.Mutex
+	running := map[string]int{}
+	maxRunning := map[string]int{}
+	var order []string
+	total := 0
+	maxTotal := 0
+
+	pool := newWorkerPool(3, func(ctx context.Context, m parsedMessage) {
+		k := m.(*keyedMsg)
+		mu.Lock()
+		running[k.key]++
+		total++
+		if running[k.key] > maxRunning[k.key] {
+			maxRunning[k.key] = running[k.key]
+		}
+		if total > maxTotal {
+			maxTotal = total
+		}
+		if k.key == "a" {
+			order = append(order, k.name)
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond * 20)
+		mu.Lock()
+		running[k.key]--
+		total--
+		mu.Unlock()
+	})
+
+	msgs := make(chan parsedMessage)
+	done := make(chan struct{})
+	go func() {
+		pool.run(context.Background(), msgs)
+		close(done)
+	}()
+	for _, m := range []*keyedMsg{{"a", "a1"}, {"a", "a2"}, {"b", "b1"}, {"", "n1"}, {"", "n2"}, {"a", "a3"}, {"b", "b2"}} {
+		msgs <- m
+	}
+	close(msgs)
+	<-done
+
+	assert.Equal(t, 1, maxRunning["a"])
+	assert.Equal(t, 1, maxRunning["b"])
+	assert.True(t, maxTotal > 1)
+	assert.True(t, maxTotal <= 3)
+	assert.Equal(t, []string{"a1", "a2", "a3"}, order)
+}
+
+func TestWorkerPoolBoundsWaiting(t *testing.T) {
+	release := make(chan struct{})
+	pool := newWorkerPool(1, func(ctx context.Context, m parsedMessage) {
+		<-release
+	})
+	msgs := make(chan parsedMessage)
+	done := make(chan struct{})
+	go func() {
+		pool.run(context.Background(), msgs)
+		close(done)
+	}()
+
+	// a1 runs and a2 waits behind it.  a3 fills the pool, which stops taking a4.
+	msgs <- &keyedMsg{"a", "a1"}
+	msgs <- &keyedMsg{"a", "a2"}
+	msgs <- &keyedMsg{"a", "a3"}
+	select {
+	case msgs <- &keyedMsg{"b", "b1"}:
+		t.Fatal("pool took a message with too many waiting")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	close(release)
+	select {
+	case msgs <- &keyedMsg{"b", "b1"}:
+	case <-time.After(time.Second * 5):
+		t.Fatal("pool never took a message once work finished")
+	}
+	close(msgs)
+	<-done
+}